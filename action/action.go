@@ -1,14 +1,16 @@
 package action
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 
 	"github.com/crawl/go-sequell/crawl/data"
 	"github.com/crawl/go-sequell/flock"
 	"github.com/crawl/go-sequell/isync"
+	"github.com/crawl/go-sequell/loader"
 	"github.com/crawl/go-sequell/logfetch"
 	"github.com/crawl/go-sequell/pg"
 	"github.com/crawl/go-sequell/resource"
@@ -69,30 +71,6 @@ func LinkLogs() error {
 	})
 }
 
-func xlogFilter(filters []string) func([]*sources.XlogSrc) []*sources.XlogSrc {
-	accept := func(file *sources.XlogSrc) bool {
-		fileDesc := file.String()
-		for _, filter := range filters {
-			if strings.Index(fileDesc, filter) != -1 {
-				return true
-			}
-		}
-		return false
-	}
-	return func(files []*sources.XlogSrc) []*sources.XlogSrc {
-		if filters == nil || len(filters) == 0 {
-			return files
-		}
-		res := make([]*sources.XlogSrc, 0, len(files))
-		for _, file := range files {
-			if accept(file) {
-				res = append(res, file)
-			}
-		}
-		return res
-	}
-}
-
 // ShowSourceURLs shows all remote Xlog URLs, including Xlogs that are no
 // longer live.
 func ShowSourceURLs() error {
@@ -107,8 +85,9 @@ func ShowSourceURLs() error {
 }
 
 // DownloadLogs downloads all logfiles, possibly filtered to a subset. If
-// incremental, ignores files that are no longer live.
-func DownloadLogs(incremental bool, filters []string) error {
+// incremental, ignores files that are no longer live. Cancelling ctx
+// abandons all downloads.
+func DownloadLogs(ctx context.Context, incremental bool, filters []string) error {
 	src, err := sources.Sources(data.Sources(), data.CrawlData(), LogCache)
 	if err != nil {
 		return err
@@ -122,17 +101,60 @@ func DownloadLogs(incremental bool, filters []string) error {
 	}
 	defer FetchLock.Unlock()
 
-	logfetch.New().DownloadAndWait(xlogFilter(filters)(src.XlogSources()), incremental)
-	return nil
+	results, err := logfetch.New().DownloadAndWait(ctx,
+		sources.FilterXlogs(src.XlogSources(), filters), incremental)
+	fmt.Fprintln(os.Stderr, "Fetched", logfetch.Summarize(results))
+	return err
+}
+
+// IsyncOptions configures the isync process.
+type IsyncOptions struct {
+	// OnRewrite is the policy for files that have been rewritten since they
+	// were last loaded: "stop", "reload" or "skip".
+	OnRewrite string
+
+	// ControlAddr is the host:port or unix:/socket/path for the HTTP control
+	// server. If empty, isync is controlled only through stdin.
+	ControlAddr string
+
+	// ControlToken, if set, is the bearer token control clients must send.
+	ControlToken string
+
+	// FetchInterval is the default interval at which live logs are fetched.
+	// If 0, only servers with a fetch-interval in sources.yml are fetched
+	// automatically.
+	FetchInterval time.Duration
+
+	// LogPollInterval, if non-zero, polls log directories for changes at
+	// this interval instead of using inotify.
+	LogPollInterval time.Duration
+
+	// Daemon runs isync without reading stdin, controlled by signals: SIGHUP
+	// reloads config, SIGUSR1 fetches logs, SIGTERM exits.
+	Daemon bool
+
+	// PidFile, if set, is locked and holds isync's pid while it runs.
+	PidFile string
 }
 
 // Isync runs the isync process that runs as a slave to Sequell and periodically
-// downloads and loads logs.
-func Isync(db pg.ConnSpec) error {
+// downloads and loads logs, until exit is requested or ctx is cancelled.
+func Isync(ctx context.Context, db pg.ConnSpec, opt IsyncOptions) error {
+	rewritePolicy, err := loader.ParseRewritePolicy(opt.OnRewrite)
+	if err != nil {
+		return err
+	}
 	if err := os.MkdirAll(LogCache, os.ModePerm); err != nil {
 		return err
 	}
 
+	if opt.PidFile != "" {
+		pidFile := flock.New(opt.PidFile)
+		if err := pidFile.Lock(false); err != nil {
+			return err
+		}
+		defer pidFile.Unlock()
+	}
 	if err := DBLock.Lock(false); err != nil {
 		return err
 	}
@@ -146,5 +168,11 @@ func Isync(db pg.ConnSpec) error {
 	if err != nil {
 		return err
 	}
-	return sync.Run()
+	sync.OnRewrite = rewritePolicy
+	sync.ControlAddr = opt.ControlAddr
+	sync.ControlToken = opt.ControlToken
+	sync.FetchInterval = opt.FetchInterval
+	sync.LogPollInterval = opt.LogPollInterval
+	sync.Daemon = opt.Daemon
+	return sync.Run(ctx)
 }
@@ -2,6 +2,7 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,11 +11,14 @@ import (
 	"strconv"
 
 	"github.com/crawl/go-sequell/action"
+	"github.com/crawl/go-sequell/compression"
 	"github.com/crawl/go-sequell/crawl/data"
 	cdb "github.com/crawl/go-sequell/crawl/db"
 	"github.com/crawl/go-sequell/crawl/xlogtools"
 	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/metrics"
 	"github.com/crawl/go-sequell/pg"
+	"github.com/crawl/go-sequell/qyaml"
 	"github.com/crawl/go-sequell/schema"
 	"github.com/crawl/go-sequell/sources"
 	"github.com/pkg/errors"
@@ -138,13 +142,16 @@ func PrintSchema(skipIndexes, dropIndexes, createIndexes bool) {
 	s.Sort().Write(sel, os.Stdout)
 }
 
-// CheckDBSchema vets the schema in dbspec for accuracy. The applyDelta
-// parameter is currently ignored.
-func CheckDBSchema(dbspec pg.ConnSpec, applyDelta bool) error {
+// CheckDBSchema vets the schema in dbspec for accuracy. If applyDelta is set,
+// missing tables, columns, indexes and constraints are added to the db in a
+// single transaction; if dryRun is also set, the upgrade DDL is printed
+// instead of being applied.
+func CheckDBSchema(dbspec pg.ConnSpec, applyDelta, dryRun bool) error {
 	db, err := dbspec.Open()
 	if err != nil {
 		return err
 	}
+	defer db.Close()
 	actualSchema, err := db.IntrospectSchema()
 	if err != nil {
 		return err
@@ -158,13 +165,90 @@ func CheckDBSchema(dbspec pg.ConnSpec, applyDelta bool) error {
 
 	fmt.Fprintf(os.Stderr, "Schema delta:\n")
 	diff.PrintDelta(os.Stderr)
-	if applyDelta {
+	if !applyDelta {
 		return nil
 	}
+
+	changed := diff.ChangedColumns()
+	for table, cols := range changed {
+		for _, col := range cols {
+			log.Printf("Cannot upgrade changed column %s.%s (want %s): migrate it by hand\n",
+				table, col.Name, col.SQL())
+		}
+	}
+
+	upgrade := diff.UpgradeSQL()
+	if len(upgrade) == 0 {
+		log.Println("No schema changes can be applied automatically.")
+		return nil
+	}
+	recount := addsFileRowCounts(diff)
+	if dryRun {
+		fmt.Print(schema.SQLCombine(upgrade))
+		if recount {
+			fmt.Println("-- then count the rows loaded from each file")
+		}
+		return nil
+	}
+	action := MigrationUpgrade
+	if len(changed) > 0 {
+		action = MigrationPartialUpgrade
+	}
+	if err = applySchemaUpgrade(db, wantedSchema.Hash(), action, upgrade, diff.DowngradeSQL()); err != nil {
+		return err
+	}
+	if recount {
+		log.Println("Counting the rows loaded from each file")
+		if err = RecountFiles(context.Background(), db, CrawlSchema()); err != nil {
+			return errors.Wrap(err, "schema upgraded, but row counts could not be backfilled; run seqdb ls-files --recount")
+		}
+	}
+	return nil
+}
+
+// addsFileRowCounts checks if the diff schema adds the row count column to
+// an existing l_file, whose files then need their rows counted: the loader
+// only counts the rows it loads.
+func addsFileRowCounts(diff *schema.Schema) bool {
+	fileTable := CrawlSchema().LookupTable(cdb.FileLookupTable)
+	if fileTable == nil {
+		return false
+	}
+	t := diff.Table(fileTable.TableName())
+	if t == nil || t.Diff != schema.Changed {
+		return false
+	}
+	c := t.Column("file_rows")
+	return c != nil && c.Diff == schema.Added
+}
+
+// applySchemaUpgrade applies the upgrade DDL statements to db in a single
+// transaction, recording the upgrade in the migrations table as action.
+func applySchemaUpgrade(db pg.DB, schemaHash, action string, upgrade, downgrade []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, sql := range upgrade {
+		log.Println("Exec:", sql)
+		if _, err = tx.Exec(sql); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "schema upgrade: %s", sql)
+		}
+	}
+	if err = recordMigration(tx, schemaHash, action, upgrade, downgrade); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return errors.Wrap(err, "schema upgrade commit")
+	}
+	log.Printf("Applied %d schema changes.\n", len(upgrade))
 	return nil
 }
 
-// CreateDBSchema creates all tables in the db.
+// CreateDBSchema creates all tables in the db, recording the schema revision
+// in the migrations table.
 func CreateDBSchema(db pg.ConnSpec) error {
 	c, err := db.Open()
 	if err != nil {
@@ -173,12 +257,22 @@ func CreateDBSchema(db pg.ConnSpec) error {
 	defer c.Close()
 	s := CrawlSchema().Schema()
 	log.Printf("Creating tables in database \"%s\"\n", db.Database)
-	for _, sql := range s.SQLSel(schema.SelTables) {
-		if _, err = c.Exec(sql); err != nil {
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	create := s.SQLSel(schema.SelTables)
+	for _, sql := range create {
+		if _, err = tx.Exec(sql); err != nil {
+			tx.Rollback()
 			return err
 		}
 	}
-	return nil
+	if err = recordMigration(tx, s.Hash(), MigrationCreate, create, dropTablesSQL(s)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 // DropDB drops the Sequell db if force is true. If terminate is specified,
@@ -220,8 +314,16 @@ func TerminateConnections(adminDB pg.DB, targetDB string) error {
 	return nil
 }
 
-// LoadLogs loads all xlogs in sourceDir into the db.
-func LoadLogs(db pg.ConnSpec, sourceDir string) error {
+// LoadLogs loads all xlogs in sourceDir into the db, using up to jobs
+// concurrent workers. Files that have been rewritten since they were last
+// loaded are handled as specified by onRewrite. If ctx is cancelled, the
+// load stops, rolling back uncommitted rows.
+func LoadLogs(ctx context.Context, db pg.ConnSpec, sourceDir string, jobs int, onRewrite string) error {
+	rewritePolicy, err := loader.ParseRewritePolicy(onRewrite)
+	if err != nil {
+		return err
+	}
+
 	c, err := db.Open()
 	if err != nil {
 		return err
@@ -240,16 +342,76 @@ func LoadLogs(db pg.ConnSpec, sourceDir string) error {
 	}
 	defer action.DBLock.Unlock()
 
-	logNorm := xlogtools.MustBuildNormalizer(data.CrawlData().YAML)
-	ldr := loader.New(c, sources, CrawlSchema(), logNorm,
-		data.CrawlData().StringMap("game-type-prefixes"))
+	ldr := newLoader(c, sources)
+	ldr.Concurrency = jobs
+	ldr.OnRewrite = rewritePolicy
 
 	if sourceDir != "" {
 		log.Println("Loading logs from", sourceDir, "into", db.Database)
 	} else {
 		log.Println("Loading logs into", db.Database)
 	}
-	return ldr.LoadCommit()
+	err = ldr.LoadCommit(ctx)
+	metrics.Default.WriteText(os.Stderr)
+	return err
+}
+
+// DryRunLoad reads the logs in sourceDir (or all configured logs, if
+// sourceDir is empty) from offset from up to offset to, and writes the rows
+// that would be loaded to stdout in format (jsonl or csv), without
+// connecting to the database. If to is 0, logs are read to the end.
+func DryRunLoad(ctx context.Context, sourceDir, format string, from, to int64) error {
+	out, err := loader.NewRowWriter(format, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	sources := Sources()
+	if sourceDir != "" {
+		if err = forceSourceDir(sources, sourceDir); err != nil {
+			return err
+		}
+	}
+	ldr := loader.NewDryRun(sources, CrawlSchema(),
+		xlogtools.MustBuildNormalizer(data.CrawlData().YAML),
+		data.CrawlData().StringMap("game-type-prefixes"))
+	return ldr.DryRun(ctx, out, from, to)
+}
+
+// NormDiff normalizes the cached logs with the crawl-data.yml at oldPath and
+// with the current crawl-data.yml, and reports the fields that normalize
+// differently. If sample is positive, only sample xlogs picked at random
+// from each log are compared.
+func NormDiff(ctx context.Context, oldPath string, sample int) error {
+	oldData, err := qyaml.Parse(oldPath)
+	if err != nil {
+		return errors.Wrap(err, oldPath)
+	}
+	oldNorm, err := xlogtools.BuildNormalizer(oldData)
+	if err != nil {
+		return errors.Wrap(err, oldPath)
+	}
+	crawlData := data.CrawlData()
+	newNorm, err := xlogtools.BuildNormalizer(crawlData.YAML)
+	if err != nil {
+		return err
+	}
+
+	ldr := loader.NewDryRun(Sources(), CrawlSchema(), newNorm,
+		crawlData.StringMap("game-type-prefixes"))
+	diff, err := ldr.NormDiff(ctx, oldNorm, newNorm, sample)
+	if err != nil {
+		return err
+	}
+	return diff.Write(os.Stdout)
+}
+
+// newLoader creates a loader for the logs in srv, using the schema and
+// normalizer configured in crawl-data.yml.
+func newLoader(c pg.DB, srv sources.Servers) *loader.Loader {
+	logNorm := xlogtools.MustBuildNormalizer(data.CrawlData().YAML)
+	return loader.New(c, srv, CrawlSchema(), logNorm,
+		data.CrawlData().StringMap("game-type-prefixes"))
 }
 
 func forceSourceDir(srv sources.Servers, dir string) error {
@@ -264,11 +426,19 @@ func forceSourceDir(srv sources.Servers, dir string) error {
 	}
 
 	sourceMap := map[string][]*sources.XlogSrc{}
+	seen := map[string]bool{}
 	for _, f := range files {
-		filename := f.Name()
+		// Compressed logs are read directly, but are named in the db as
+		// though they had been decompressed:
+		filename := compression.StripExtension(f.Name())
 		if !xlogtools.IsXlogQualifiedName(filename) {
 			continue
 		}
+		if seen[filename] {
+			log.Printf("Ignoring %s: %s is already loaded from another file\n", f.Name(), filename)
+			continue
+		}
+		seen[filename] = true
 		gameType := xlogtools.NewGameMatcher(data.CrawlData())
 		src, game, xtype := gameType.XlogServerType(filename)
 		if xtype == xlogtools.Unknown {
@@ -284,11 +454,12 @@ func forceSourceDir(srv sources.Servers, dir string) error {
 
 		xl := sources.XlogSrc{
 			Server:        server,
-			Name:          filename,
-			TargetPath:    path.Join(dir, filename),
+			Name:          f.Name(),
+			TargetPath:    path.Join(dir, f.Name()),
 			TargetRelPath: filename,
 			Type:          xtype,
 			Game:          game,
+			Compression:   compression.FilenameFormat(f.Name()),
 		}
 		sourceMap[src] = append(sourceMap[src], &xl)
 	}
@@ -317,30 +488,6 @@ func CreateIndexes(db pg.ConnSpec) error {
 	return nil
 }
 
-// ListFiles lists all logfiles that have been loaded (even partially) into the
-// db.
-func ListFiles(db pg.ConnSpec) error {
-	c, err := db.Open()
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	rows, err := c.Query("select file from l_file order by file")
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var file string
-		if err = rows.Scan(&file); err != nil {
-			return err
-		}
-		fmt.Println(file)
-	}
-	return rows.Err()
-}
-
 // DeleteFileRows deletes all games and milestones loaded from the list of
 // files given.
 func DeleteFileRows(db pg.ConnSpec, files []string) error {
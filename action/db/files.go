@@ -0,0 +1,258 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cdb "github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/pg"
+	"github.com/crawl/go-sequell/sources"
+	"github.com/pkg/errors"
+)
+
+// FileListOptions selects the files listed by ListFiles, and how they are
+// shown.
+type FileListOptions struct {
+	// Server and Game, if not empty, list only files from that server or
+	// of that game type.
+	Server string
+	Game   string
+
+	// Backlog lists only files with data on disk that is not yet loaded.
+	Backlog bool
+
+	// JSON lists files as a JSON array instead of a table.
+	JSON bool
+
+	// Recount recomputes the row counts and row times of all files from
+	// the game and milestone tables before listing them.
+	Recount bool
+}
+
+// A FileInfo describes a logfile in l_file. Fields that are unknown are nil.
+type FileInfo struct {
+	File     string `json:"file"`
+	Server   string `json:"server"`
+	URL      string `json:"url"`
+	Game     string `json:"game"`
+	XlogType string `json:"xlog_type"`
+
+	// Size is the size of the file on disk, and LoadedOffset the offset
+	// of the end of the last line loaded; Backlog is the difference.
+	Size         *int64 `json:"size"`
+	LoadedOffset *int64 `json:"loaded_offset"`
+	Backlog      *int64 `json:"backlog"`
+
+	Rows      int64      `json:"rows"`
+	FirstTime *time.Time `json:"first_time"`
+	LastTime  *time.Time `json:"last_time"`
+	LoadedAt  *time.Time `json:"loaded_at"`
+}
+
+func (f *FileInfo) matches(opt FileListOptions) bool {
+	return (opt.Server == "" || f.Server == opt.Server) &&
+		(opt.Game == "" || f.Game == opt.Game) &&
+		(!opt.Backlog || (f.Backlog != nil && *f.Backlog > 0))
+}
+
+// ListFiles lists the logfiles that have been loaded (even partially) into
+// the db, with their sources, sizes on disk, unloaded backlogs and the rows
+// loaded from them.
+func ListFiles(ctx context.Context, dbc pg.ConnSpec, opt FileListOptions) error {
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if opt.Recount {
+		if err = RecountFiles(ctx, c, CrawlSchema()); err != nil {
+			return err
+		}
+	}
+	files, err := queryFiles(ctx, c, Sources())
+	if err != nil {
+		return err
+	}
+	matched := make([]*FileInfo, 0, len(files))
+	for _, f := range files {
+		if f.matches(opt) {
+			matched = append(matched, f)
+		}
+	}
+	if opt.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(matched)
+	}
+	return writeFileTable(os.Stdout, matched)
+}
+
+// queryFiles reads the files in l_file. Sources not recorded in l_file (for
+// files loaded by older versions of seqdb) are filled in from srv, and sizes
+// and backlogs are read from the files in srv.
+func queryFiles(ctx context.Context, c pg.DB, srv sources.Servers) ([]*FileInfo, error) {
+	rows, err := c.QueryContext(ctx, `select file, file_offset, file_server, file_url,
+											 file_game, file_xlog_type, file_rows,
+											 file_first_time, file_last_time, file_loaded_at
+										from l_file order by file`)
+	if err != nil {
+		return nil, errors.Wrap(err, "queryFiles")
+	}
+	defer rows.Close()
+
+	srcs := map[string]*sources.XlogSrc{}
+	for _, x := range srv.XlogSources() {
+		srcs[loader.NormalizeValue(x.TargetRelPath)] = x
+	}
+
+	files := []*FileInfo{}
+	for rows.Next() {
+		var f FileInfo
+		var offset, nrows sql.NullInt64
+		var server, url, game, xlogType sql.NullString
+		if err = rows.Scan(&f.File, &offset, &server, &url, &game, &xlogType, &nrows,
+			&f.FirstTime, &f.LastTime, &f.LoadedAt); err != nil {
+			return nil, err
+		}
+		f.Server, f.URL, f.Game, f.XlogType = server.String, url.String, game.String, xlogType.String
+		f.Rows = nrows.Int64
+
+		if x := srcs[f.File]; x != nil {
+			if !server.Valid {
+				f.Server, f.URL, f.Game, f.XlogType = x.Server.Name, x.URL, x.Game, x.Type.String()
+			}
+			if fi, err := os.Stat(x.TargetPath); err == nil {
+				size := fi.Size()
+				f.Size = &size
+			}
+			loaded := int64(0)
+			if offset.Valid {
+				loaded = loadedEnd(x.TargetPath, offset.Int64)
+			}
+			f.LoadedOffset = &loaded
+			if f.Size != nil {
+				backlog := *f.Size - loaded
+				if backlog < 0 {
+					backlog = 0
+				}
+				f.Backlog = &backlog
+			}
+		} else if offset.Valid {
+			f.LoadedOffset = &offset.Int64
+		}
+		files = append(files, &f)
+	}
+	return files, rows.Err()
+}
+
+// loadedEnd returns the offset of the end of the line at offset in the file
+// at path, which is where loading resumes, or offset if the line cannot be
+// read.
+func loadedEnd(path string, offset int64) int64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return offset
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil {
+		return offset
+	}
+	return offset + int64(len(line))
+}
+
+// writeFileTable writes files to w as a table.
+func writeFileTable(w io.Writer, files []*FileInfo) error {
+	optInt := func(n *int64) string {
+		if n == nil {
+			return "-"
+		}
+		return strconv.FormatInt(*n, 10)
+	}
+	optTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+	optString := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSERVER\tGAME\tTYPE\tSIZE\tLOADED\tBACKLOG\tROWS\tFIRST\tLAST\tLOADED AT\tURL")
+	for _, f := range files {
+		fmt.Fprintln(tw, strings.Join([]string{
+			f.File, optString(f.Server), optString(f.Game), optString(f.XlogType),
+			optInt(f.Size), optInt(f.LoadedOffset), optInt(f.Backlog),
+			strconv.FormatInt(f.Rows, 10), optTime(f.FirstTime), optTime(f.LastTime),
+			optTime(f.LoadedAt), optString(f.URL),
+		}, "\t"))
+	}
+	return tw.Flush()
+}
+
+// RecountFiles recomputes the row counts and first and last row times of the
+// files in l_file from the game and milestone tables.
+func RecountFiles(ctx context.Context, c pg.DB, sch *cdb.CrawlSchema) error {
+	counts := []string{}
+	for _, prefix := range sch.TableVariantPrefixes {
+		for _, table := range sch.Tables {
+			fileField := table.FindField(cdb.FileLookupTable)
+			if fileField == nil {
+				continue
+			}
+			timeField := table.FindField("end")
+			if timeField == nil {
+				timeField = table.FindField("time")
+			}
+			if timeField == nil {
+				continue
+			}
+			counts = append(counts, `select `+fileField.RefName()+` as file_id,
+					count(*) as n, min(`+timeField.SQLName+`) as first_time,
+					max(`+timeField.SQLName+`) as last_time
+				from `+prefix+table.Name+` group by `+fileField.RefName())
+		}
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, `update l_file set file_rows = 0,
+								   file_first_time = null, file_last_time = null`); err != nil {
+		return errors.Wrap(err, "RecountFiles")
+	}
+	if _, err = tx.ExecContext(ctx, `update l_file f
+		set file_rows = c.n, file_first_time = c.first_time, file_last_time = c.last_time
+		from (select file_id, sum(n) as n, min(first_time) as first_time,
+					 max(last_time) as last_time
+				from (`+strings.Join(counts, " union all ")+`) as u
+			   group by file_id) as c
+		where f.id = c.file_id`); err != nil {
+		return errors.Wrap(err, "RecountFiles")
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadedEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seqdb-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logfile")
+	if err = ioutil.WriteFile(path, []byte("name=a\nname=bb\nname=c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		offset   int64
+		expected int64
+	}{
+		{path, 0, 7},
+		{path, 7, 15},
+		{path, 15, 15},
+		{filepath.Join(dir, "missing"), 7, 7},
+	}
+	for _, test := range tests {
+		if end := loadedEnd(test.path, test.offset); end != test.expected {
+			t.Errorf("loadedEnd(%s, %d) = %d, expected %d",
+				filepath.Base(test.path), test.offset, end, test.expected)
+		}
+	}
+}
+
+func TestFileInfoMatches(t *testing.T) {
+	backlog, none := int64(120), int64(0)
+	files := []*FileInfo{
+		{File: "cao/logfile", Server: "cao", Game: "", Backlog: &backlog},
+		{File: "cao/spr-logfile", Server: "cao", Game: "sprint", Backlog: &none},
+		{File: "cdo/logfile", Server: "cdo"},
+	}
+	tests := []struct {
+		opt      FileListOptions
+		expected []string
+	}{
+		{FileListOptions{}, []string{"cao/logfile", "cao/spr-logfile", "cdo/logfile"}},
+		{FileListOptions{Server: "cao"}, []string{"cao/logfile", "cao/spr-logfile"}},
+		{FileListOptions{Game: "sprint"}, []string{"cao/spr-logfile"}},
+		{FileListOptions{Backlog: true}, []string{"cao/logfile"}},
+	}
+	for _, test := range tests {
+		matched := []string{}
+		for _, f := range files {
+			if f.matches(test.opt) {
+				matched = append(matched, f.File)
+			}
+		}
+		if len(matched) != len(test.expected) {
+			t.Errorf("%#v matched %v, expected %v", test.opt, matched, test.expected)
+			continue
+		}
+		for i := range matched {
+			if matched[i] != test.expected[i] {
+				t.Errorf("%#v matched %v, expected %v", test.opt, matched, test.expected)
+				break
+			}
+		}
+	}
+}
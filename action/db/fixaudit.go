@@ -0,0 +1,267 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crawl/go-sequell/action"
+	cdb "github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/pg"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// FixRunTable records each run of a data fix command, and FixAuditTable the
+// old and new values of every column the run changed.
+const (
+	FixRunTable   = cdb.FixRunTable
+	FixAuditTable = cdb.FixAuditTable
+)
+
+// fixAuditTablesExist checks if the db has the fix run and audit tables,
+// which are created by seqdb migrate up.
+func fixAuditTablesExist(c pg.DB) (bool, error) {
+	for _, table := range []string{FixRunTable, FixAuditTable} {
+		exists, err := c.TableExists(table)
+		if err != nil || !exists {
+			return false, errors.Wrap(err, "fixAuditTablesExist")
+		}
+	}
+	return true, nil
+}
+
+// A fixRun records the changes made by one data fix command.
+type fixRun struct {
+	id int64
+}
+
+// A fixChange is a column value changed by a fix run. Values are stored as
+// text, and a null value is invalid.
+type fixChange struct {
+	rowID              int64
+	oldValue, newValue sql.NullString
+}
+
+// startFixRun records a new fix run for command. The db must have the fix
+// audit tables, so that every change can be undone.
+func startFixRun(ctx context.Context, c pg.DB, command string) (*fixRun, error) {
+	exists, err := fixAuditTablesExist(c)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("cannot record fix runs: the db schema is out of date; run seqdb migrate up")
+	}
+	run := &fixRun{}
+	err = c.QueryRowContext(ctx,
+		`insert into `+FixRunTable+` (command) values ($1) returning id`,
+		command).Scan(&run.id)
+	return run, errors.Wrap(err, "startFixRun")
+}
+
+// record saves changes to column (of columnType) in table, in tx.
+func (r *fixRun) record(ctx context.Context, tx *sql.Tx, table, column, columnType string, changes []fixChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	buf := bytes.Buffer{}
+	buf.WriteString(`insert into ` + FixAuditTable + `
+	  (run_id, table_name, column_name, column_type, row_id, old_value, new_value)
+	  values `)
+	binder := pg.NewBinder()
+	binds := make([]interface{}, 0, 4+len(changes)*3)
+	runBind, tableBind, columnBind, typeBind :=
+		binder.Next(), binder.Next(), binder.Next(), binder.Next()
+	binds = append(binds, r.id, table, column, columnType)
+	for i, change := range changes {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("(" + runBind + "," + tableBind + "," + columnBind + "," +
+			typeBind + "," + binder.Next() + "," + binder.Next() + "," +
+			binder.Next() + ")")
+		binds = append(binds, change.rowID, change.oldValue, change.newValue)
+	}
+	_, err := tx.ExecContext(ctx, buf.String(), binds...)
+	return errors.Wrap(err, "record fix changes")
+}
+
+// A FixRun is a recorded run of a data fix command.
+type FixRun struct {
+	ID        int64
+	Command   string
+	StartedAt time.Time
+	UndoneAt  *time.Time
+	Changes   int64
+}
+
+// ListFixRuns writes the recorded fix runs, with the number of changes each
+// made, to stdout. A db without the fix audit tables has no fix runs.
+func ListFixRuns(ctx context.Context, dbc pg.ConnSpec) error {
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	exists, err := fixAuditTablesExist(c)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN\tSTARTED\tCHANGES\tUNDONE\tCOMMAND")
+	if !exists {
+		return w.Flush()
+	}
+
+	rows, err := c.QueryContext(ctx, `select r.id, r.command, r.started_at, r.undone_at,
+	  (select count(*) from `+FixAuditTable+` a where a.run_id = r.id)
+	  from `+FixRunTable+` r order by r.id`)
+	if err != nil {
+		return errors.Wrap(err, "ListFixRuns")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var run FixRun
+		if err = rows.Scan(&run.ID, &run.Command, &run.StartedAt, &run.UndoneAt, &run.Changes); err != nil {
+			return err
+		}
+		undone := ""
+		if run.UndoneAt != nil {
+			undone = run.UndoneAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", run.ID,
+			run.StartedAt.Format("2006-01-02 15:04:05"), run.Changes, undone, run.Command)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// A fixColumn is a column changed by a fix run.
+type fixColumn struct {
+	table, column, columnType string
+}
+
+// fixRunColumns returns the columns changed by the fix run runID.
+func fixRunColumns(ctx context.Context, tx *sql.Tx, runID int64) ([]fixColumn, error) {
+	rows, err := tx.QueryContext(ctx, `select distinct table_name, column_name, column_type
+										 from `+FixAuditTable+`
+										where run_id = $1
+										order by table_name, column_name`, runID)
+	if err != nil {
+		return nil, errors.Wrap(err, "fixRunColumns")
+	}
+	defer rows.Close()
+	res := []fixColumn{}
+	for rows.Next() {
+		var col fixColumn
+		if err = rows.Scan(&col.table, &col.column, &col.columnType); err != nil {
+			return nil, err
+		}
+		res = append(res, col)
+	}
+	return res, rows.Err()
+}
+
+// fixAuditValues is a query for the changes to a column by a fix run: the
+// first change to each row for its old value, or the last for its new value.
+func fixAuditValues(valueColumn, order string) string {
+	return `select distinct on (row_id) row_id, ` + valueColumn + ` as value
+			  from ` + FixAuditTable + `
+			 where run_id = $1 and table_name = $2 and column_name = $3
+			 order by row_id, id ` + order
+}
+
+// UndoFixRun restores the values changed by the fix run runID. Rows that
+// were changed again after the run are not restored unless force is set.
+func UndoFixRun(ctx context.Context, dbc pg.ConnSpec, runID int64, force bool) error {
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := action.DBLock.Lock(false); err != nil {
+		return err
+	}
+	defer action.DBLock.Unlock()
+
+	exists, err := fixAuditTablesExist(c)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no fix run %d", runID)
+	}
+
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var command string
+	var undoneAt *time.Time
+	err = tx.QueryRowContext(ctx, `select command, undone_at from `+FixRunTable+`
+									 where id = $1 for update`, runID).Scan(&command, &undoneAt)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no fix run %d", runID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "UndoFixRun")
+	}
+	if undoneAt != nil {
+		return fmt.Errorf("fix run %d (%s) was already undone at %s", runID, command,
+			undoneAt.Format("2006-01-02 15:04:05"))
+	}
+
+	columns, err := fixRunColumns(ctx, tx, runID)
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		table := pq.QuoteIdentifier(col.table)
+		column := pq.QuoteIdentifier(col.column)
+		binds := []interface{}{runID, col.table, col.column}
+		if !force {
+			var changedSince int64
+			if err = tx.QueryRowContext(ctx, `select count(*) from `+table+` as t,
+				(`+fixAuditValues("new_value", "desc")+`) as a
+				where t.id = a.row_id and t.`+column+`::text is distinct from a.value`,
+				binds...).Scan(&changedSince); err != nil {
+				return errors.Wrapf(err, "UndoFixRun: %s.%s", col.table, col.column)
+			}
+			if changedSince > 0 {
+				return fmt.Errorf("%d rows of %s.%s changed since fix run %d; use --force to restore them anyway",
+					changedSince, col.table, col.column, runID)
+			}
+		}
+		res, err := tx.ExecContext(ctx, `update `+table+` as t
+			set `+column+` = a.value::`+col.columnType+`
+			from (`+fixAuditValues("old_value", "asc")+`) as a
+			where t.id = a.row_id`, binds...)
+		if err != nil {
+			return errors.Wrapf(err, "UndoFixRun: %s.%s", col.table, col.column)
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			fmt.Printf("Restored %d rows of %s.%s\n", n, col.table, col.column)
+		}
+	}
+
+	if _, err = tx.ExecContext(ctx, `update `+FixRunTable+` set undone_at = now()
+									  where id = $1`, runID); err != nil {
+		return errors.Wrap(err, "UndoFixRun")
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Undid fix run %d (%s)\n", runID, command)
+	return nil
+}
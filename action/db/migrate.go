@@ -0,0 +1,249 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/crawl/go-sequell/pg"
+	"github.com/crawl/go-sequell/schema"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// MigrationsTable is the table that records the schema changes applied to
+// Sequell's database.
+const MigrationsTable = "sequell_schema_migrations"
+
+// Migration actions recorded in the migrations table. A partial upgrade is
+// an upgrade that left changed columns to be migrated by hand, so the db
+// does not fully match its recorded schema.
+const (
+	MigrationCreate         = "create"
+	MigrationUpgrade        = "upgrade"
+	MigrationPartialUpgrade = "partial upgrade"
+)
+
+var migrationsTableDDL = `create table if not exists ` + MigrationsTable + ` (
+  id serial primary key,
+  schema_hash text not null,
+  action text not null,
+  applied_at timestamp not null default now(),
+  up_sql text[] not null,
+  down_sql text[] not null,
+  rolled_back_at timestamp
+)`
+
+// A Migration is a single schema change applied to the db: either creating
+// all tables, or upgrading an existing schema.
+type Migration struct {
+	ID           int64
+	SchemaHash   string
+	Action       string
+	AppliedAt    time.Time
+	UpSQL        []string
+	DownSQL      []string
+	RolledBackAt *time.Time
+}
+
+// RolledBack returns true if m has been reverted.
+func (m *Migration) RolledBack() bool {
+	return m.RolledBackAt != nil
+}
+
+// CurrentSchemaHash returns the hash of the schema configured in
+// crawl-data.yml.
+func CurrentSchemaHash() string {
+	return CrawlSchema().Schema().Hash()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func createMigrationsTable(c execer) error {
+	_, err := c.Exec(migrationsTableDDL)
+	return errors.Wrap(err, "create "+MigrationsTable)
+}
+
+// recordMigration logs a schema change in the migrations table.
+func recordMigration(c execer, schemaHash, action string, up, down []string) error {
+	if err := createMigrationsTable(c); err != nil {
+		return err
+	}
+	_, err := c.Exec(`insert into `+MigrationsTable+`
+						(schema_hash, action, up_sql, down_sql)
+				 values ($1, $2, $3, $4)`,
+		schemaHash, action, pq.Array(up), pq.Array(down))
+	return errors.Wrap(err, "recordMigration")
+}
+
+// listMigrations lists all migrations applied to the db, oldest first. A db
+// without a migrations table has no migrations.
+func listMigrations(c pg.DB) ([]*Migration, error) {
+	exists, err := c.TableExists(MigrationsTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "listMigrations")
+	}
+	if !exists {
+		return []*Migration{}, nil
+	}
+	rows, err := c.Query(`select id, schema_hash, action, applied_at,
+								 up_sql, down_sql, rolled_back_at
+							from ` + MigrationsTable + ` order by id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	migrations := []*Migration{}
+	for rows.Next() {
+		var m Migration
+		var rolledBack pq.NullTime
+		if err = rows.Scan(&m.ID, &m.SchemaHash, &m.Action, &m.AppliedAt,
+			pq.Array(&m.UpSQL), pq.Array(&m.DownSQL), &rolledBack); err != nil {
+			return nil, err
+		}
+		if rolledBack.Valid {
+			m.RolledBackAt = &rolledBack.Time
+		}
+		migrations = append(migrations, &m)
+	}
+	return migrations, rows.Err()
+}
+
+// lastAppliedMigration returns the most recent migration that has not been
+// rolled back, or nil if there is none.
+func lastAppliedMigration(migrations []*Migration) *Migration {
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if !migrations[i].RolledBack() {
+			return migrations[i]
+		}
+	}
+	return nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// MigrationStatus shows the schema revision the db is at, and the history
+// of schema changes applied to it.
+func MigrationStatus(dbspec pg.ConnSpec) error {
+	c, err := dbspec.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	migrations, err := listMigrations(c)
+	if err != nil {
+		return err
+	}
+
+	currentHash := CurrentSchemaHash()
+	fmt.Println("crawl-data.yml schema:", shortHash(currentHash))
+	last := lastAppliedMigration(migrations)
+	switch {
+	case last == nil:
+		fmt.Println("database schema:      unknown (no migrations recorded)")
+	case last.SchemaHash == currentHash && last.Action == MigrationPartialUpgrade:
+		fmt.Println("database schema:     ", shortHash(last.SchemaHash),
+			"(partial: changed columns must be migrated by hand; see checkdb)")
+	case last.SchemaHash == currentHash:
+		fmt.Println("database schema:     ", shortHash(last.SchemaHash), "(up-to-date)")
+	default:
+		fmt.Println("database schema:     ", shortHash(last.SchemaHash),
+			"(differs from crawl-data.yml; try checkdb --upgrade)")
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tAPPLIED\tACTION\tSCHEMA\tSTATEMENTS\tSTATUS")
+	for _, m := range migrations {
+		status := "applied"
+		if m.RolledBack() {
+			status = "rolled back " + m.RolledBackAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", m.ID,
+			m.AppliedAt.Format("2006-01-02 15:04:05"), m.Action,
+			shortHash(m.SchemaHash), len(m.UpSQL), status)
+	}
+	return w.Flush()
+}
+
+// RollbackMigration reverts the most recent migration that has not already
+// been rolled back. Unless force is set, RollbackMigration only prints the
+// DDL that would be executed.
+func RollbackMigration(dbspec pg.ConnSpec, force bool) error {
+	c, err := dbspec.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	migrations, err := listMigrations(c)
+	if err != nil {
+		return err
+	}
+	m := lastAppliedMigration(migrations)
+	if m == nil {
+		return fmt.Errorf("no migrations to roll back")
+	}
+	if len(m.DownSQL) == 0 {
+		return fmt.Errorf("migration %d (%s) has no rollback DDL", m.ID, m.Action)
+	}
+
+	if !force {
+		fmt.Fprintf(os.Stderr, "Rollback of migration %d (%s, schema %s); use --force to apply:\n",
+			m.ID, m.Action, shortHash(m.SchemaHash))
+		fmt.Print(schema.SQLCombine(m.DownSQL))
+		return nil
+	}
+
+	if m.Action == MigrationCreate {
+		log.Printf("Rolling back migration %d drops all Sequell tables in \"%s\"\n",
+			m.ID, dbspec.Database)
+	}
+	tx, err := c.Begin()
+	if err != nil {
+		return err
+	}
+	for _, sql := range m.DownSQL {
+		log.Println("Exec:", sql)
+		if _, err = tx.Exec(sql); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "rollback %d: %s", m.ID, sql)
+		}
+	}
+	if _, err = tx.Exec(`update `+MigrationsTable+` set rolled_back_at = now()
+						  where id = $1`, m.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Rolled back migration %d (%s)\n", m.ID, m.Action)
+	return nil
+}
+
+// dropTablesSQL returns the DDL to drop all tables in s, in reverse
+// dependency order.
+func dropTablesSQL(s *schema.Schema) []string {
+	s.Sort()
+	sqls := make([]string, 0, len(s.Tables))
+	for i := len(s.Tables) - 1; i >= 0; i-- {
+		sqls = append(sqls, s.Tables[i].DropSQL()...)
+	}
+	return sqls
+}
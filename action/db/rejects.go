@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/crawl/go-sequell/action"
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/pg"
+)
+
+// ListRejects lists the xlog lines from files (or from all files, if files is
+// empty) that were rejected by the loader. If showLines is set, the text of
+// each rejected line is printed below it.
+func ListRejects(ctx context.Context, dbspec pg.ConnSpec, files []string, showLines bool) error {
+	c, err := dbspec.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	rejects, err := loader.ListRejects(ctx, c, files)
+	if err != nil {
+		return err
+	}
+	if len(rejects) == 0 {
+		fmt.Println("No rejected lines.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILE\tOFFSET\tREJECTED\tREASON")
+	for _, r := range rejects {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", r.ID, r.File, r.Offset,
+			r.RejectedAt.Format("2006-01-02 15:04:05"), r.Reason)
+		if showLines {
+			fmt.Fprintf(w, "\t%s\n", r.Line)
+		}
+	}
+	return w.Flush()
+}
+
+// RetryRejects loads the rejected xlog lines from files (or from all files,
+// if files is empty) that the current parser and normalizer accept.
+func RetryRejects(ctx context.Context, dbspec pg.ConnSpec, files []string) error {
+	c, err := dbspec.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := action.DBLock.Lock(false); err != nil {
+		return err
+	}
+	defer action.DBLock.Unlock()
+
+	ldr := newLoader(c, Sources())
+	loaded, rejected, err := ldr.RetryRejects(ctx, files)
+	log.Printf("Retried rejected lines: %d loaded, %d still rejected\n", loaded, rejected)
+	return err
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/crawl/go-sequell/action"
+	"github.com/crawl/go-sequell/crawl/data"
+	"github.com/crawl/go-sequell/crawl/xlogtools"
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/pg"
+	"github.com/crawl/go-sequell/sources"
+	"github.com/pkg/errors"
+)
+
+// fileGlob compiles a file glob to a regexp matching the whole file name.
+// Unlike path.Match, * and ? also match "/", since the names in l_file are
+// paths (server/url/file).
+func fileGlob(glob string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch ch := glob[i]; ch {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("bad file pattern %#v: unterminated [", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	buf.WriteString("$")
+	re, err := regexp.Compile(buf.String())
+	return re, errors.Wrapf(err, "bad file pattern %#v", glob)
+}
+
+// matchLoadedFiles returns the files in l_file that match any of globs (see
+// fileGlob), or all files if globs is empty. Globs are matched against the
+// file names as stored, with underscores as spaces.
+func matchLoadedFiles(ctx context.Context, c pg.DB, globs []string) ([]string, error) {
+	patterns := make([]*regexp.Regexp, len(globs))
+	for i, glob := range globs {
+		re, err := fileGlob(loader.NormalizeValue(glob))
+		if err != nil {
+			return nil, err
+		}
+		patterns[i] = re
+	}
+
+	rows, err := c.QueryContext(ctx, "select file from l_file order by file")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matched := map[string]bool{}
+	files := []string{}
+	for rows.Next() {
+		var file string
+		if err = rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		if len(patterns) == 0 {
+			files = append(files, file)
+			continue
+		}
+		for i, re := range patterns {
+			if re.MatchString(file) {
+				matched[globs[i]] = true
+				files = append(files, file)
+				break
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, glob := range globs {
+		if !matched[glob] {
+			return nil, fmt.Errorf("no loaded file matches %s", glob)
+		}
+	}
+	return files, nil
+}
+
+// sourceFilenames maps the stored names of files in l_file to the db
+// filenames of the readers in ldr.
+func sourceFilenames(ldr *loader.Loader) map[string]string {
+	res := map[string]string{}
+	for _, r := range ldr.Readers {
+		res[loader.NormalizeValue(r.Filename)] = r.Filename
+	}
+	return res
+}
+
+// ReloadFiles deletes the rows loaded from each file in l_file matching
+// globs, and loads the file again with the current normalizer, in one
+// transaction per file. If dryRun is set, ReloadFiles shows the number of
+// rows now loaded from each file and the number a reload would load,
+// without changing the db.
+func ReloadFiles(ctx context.Context, dbc pg.ConnSpec, globs []string, dryRun bool) error {
+	if len(globs) == 0 {
+		return fmt.Errorf("no files specified")
+	}
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !dryRun {
+		if err := action.DBLock.Lock(false); err != nil {
+			return err
+		}
+		defer action.DBLock.Unlock()
+	}
+
+	files, err := matchLoadedFiles(ctx, c, globs)
+	if err != nil {
+		return err
+	}
+	srv := Sources()
+	ldr := newLoader(c, srv)
+	defer ldr.Close()
+	filenames := sourceFilenames(ldr)
+	for _, file := range files {
+		if _, ok := filenames[file]; !ok {
+			return fmt.Errorf("no source for %s", file)
+		}
+	}
+
+	if dryRun {
+		return showReloadCounts(ctx, ldr, srv, files, filenames)
+	}
+	for _, file := range files {
+		deleted, loaded, err := ldr.ReloadFile(ctx, filenames[file])
+		if err != nil {
+			return err
+		}
+		log.Printf("%s: deleted %d rows, loaded %d rows\n", file, sumCounts(deleted), loaded)
+	}
+	return nil
+}
+
+// showReloadCounts prints the rows loaded from each file by table, and the
+// rows a reload would load.
+func showReloadCounts(ctx context.Context, ldr *loader.Loader, srv sources.Servers, files []string, filenames map[string]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tTABLE\tLOADED\tRELOAD")
+	sch := CrawlSchema()
+	norm := xlogtools.MustBuildNormalizer(data.CrawlData().YAML)
+	gameTypePrefixes := data.CrawlData().StringMap("game-type-prefixes")
+	for _, file := range files {
+		loaded, err := ldr.FileRowCounts(ctx, file)
+		if err != nil {
+			return err
+		}
+		reload := loader.RowCounter{}
+		dry := loader.NewDryRun(srv, sch, norm, gameTypePrefixes)
+		readers := dry.Readers[:0]
+		for _, r := range dry.Readers {
+			if r.Filename == filenames[file] {
+				readers = append(readers, r)
+			}
+		}
+		dry.Readers = readers
+		if err = dry.DryRun(ctx, reload, 0, 0); err != nil {
+			return err
+		}
+
+		tables := countTables(loaded, reload)
+		if len(tables) == 0 {
+			fmt.Fprintf(w, "%s\t-\t0\t0\n", file)
+		}
+		for _, table := range tables {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", file, table, loaded[table], reload[table])
+		}
+	}
+	return w.Flush()
+}
+
+// countTables returns the sorted tables with counts in any of counts.
+func countTables(counts ...map[string]int64) []string {
+	seen := map[string]bool{}
+	tables := []string{}
+	for _, c := range counts {
+		for table := range c {
+			if !seen[table] {
+				seen[table] = true
+				tables = append(tables, table)
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func sumCounts(counts map[string]int64) int64 {
+	var sum int64
+	for _, n := range counts {
+		sum += n
+	}
+	return sum
+}
@@ -0,0 +1,35 @@
+package db
+
+import "testing"
+
+func TestFileGlob(t *testing.T) {
+	tests := []struct {
+		glob, file string
+		match      bool
+	}{
+		{"*", "cao/http://crawl.akrasiac.org/logfile", true},
+		{"cao/*", "cao/http://crawl.akrasiac.org/logfile", true},
+		{"*logfile", "cao/http://crawl.akrasiac.org/logfile", true},
+		{"*milestones", "cao/http://crawl.akrasiac.org/logfile", false},
+		{"cao/logfile?", "cao/logfile1", true},
+		{"cao/logfile?", "cao/logfile", false},
+		{"cao/logfile[0-9]", "cao/logfile3", true},
+		{"cao/logfile[!0-9]", "cao/logfile3", false},
+		{"cao/logfile.1", "cao/logfilex1", false},
+		{"cdo/*", "cao/logfile", false},
+	}
+	for _, test := range tests {
+		re, err := fileGlob(test.glob)
+		if err != nil {
+			t.Errorf("fileGlob(%#v) failed: %s", test.glob, err)
+			continue
+		}
+		if match := re.MatchString(test.file); match != test.match {
+			t.Errorf("fileGlob(%#v) match %#v = %t, expected %t", test.glob, test.file, match, test.match)
+		}
+	}
+
+	if _, err := fileGlob("cao/[logfile"); err == nil {
+		t.Errorf("fileGlob with unterminated [ succeeded, expected error")
+	}
+}
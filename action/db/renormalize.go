@@ -0,0 +1,554 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/crawl/go-sequell/action"
+	cdb "github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/pg"
+	"github.com/pkg/errors"
+)
+
+// renormBatchSize is the number of rows read and updated in each transaction
+// by a renormalization.
+const renormBatchSize = 5000
+
+// renormHistogramSize is the number of value changes listed in a
+// renormalization report.
+const renormHistogramSize = 25
+
+// A Renormalizer recomputes one field of the rows already in Sequell's db
+// from the current values of the row's fields.
+//
+// If any game or milestone table has Field, the renormalizer updates those
+// tables, resolving lookup values through their lookup tables. Otherwise Field
+// must be a column derived from a lookup table's value (such as vnum in
+// l_version), and the renormalizer updates the lookup table.
+type Renormalizer struct {
+	// Name identifies the renormalizer in reports.
+	Name string
+
+	// Field is the field that is recomputed.
+	Field string
+
+	// Inputs are the fields whose values are passed to Normalize; if
+	// empty, Normalize is passed the value of Field.
+	Inputs []string
+
+	// Where restricts the renormalizer to rows where each named field has
+	// the given value.
+	Where map[string]string
+
+	// Prefilter, if set, returns an SQL condition that selects the rows
+	// that may change, so that other rows are not scanned. It is passed the
+	// SQL expressions for Inputs and the binder for the condition's binds.
+	Prefilter func(inputs []string, binder *pg.Binder) (cond string, binds []interface{})
+
+	// Normalize returns the new value of Field given the values of Inputs.
+	Normalize func(inputs []string) (string, error)
+}
+
+func (r *Renormalizer) inputs() []string {
+	if len(r.Inputs) == 0 {
+		return []string{r.Field}
+	}
+	return r.Inputs
+}
+
+// namedRenormalizers returns the renormalizers that seqdb renormalize accepts
+// by name, in addition to the fields with transforms in crawl-data.yml.
+func namedRenormalizers() map[string][]*Renormalizer {
+	return map[string][]*Renormalizer{
+		"char":           {CharRenormalizer()},
+		"god-ecumenical": {GodEcumenicalRenormalizer()},
+		"versions":       VersionRenormalizers(),
+	}
+}
+
+// FindRenormalizers returns the renormalizers for names, which may be the
+// names of renormalizers (char, god-ecumenical or versions), or fields that
+// have transforms in crawl-data.yml.
+func FindRenormalizers(names []string) ([]*Renormalizer, error) {
+	named := namedRenormalizers()
+	res := []*Renormalizer{}
+	for _, name := range names {
+		if renorms, ok := named[name]; ok {
+			res = append(res, renorms...)
+			continue
+		}
+		gen, err := findFieldGen(name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, FieldGenRenormalizer(gen))
+	}
+	return res, nil
+}
+
+// A RenormReport counts the rows examined and changed by a Renormalizer.
+type RenormReport struct {
+	Name    string
+	Rows    int64
+	Changed int64
+
+	// Changes counts changed rows by their before and after values.
+	Changes map[RenormChange]int64
+}
+
+// A RenormChange is a change in a field's value from Before to After.
+type RenormChange struct {
+	Before, After string
+}
+
+func newRenormReport(name string) *RenormReport {
+	return &RenormReport{Name: name, Changes: map[RenormChange]int64{}}
+}
+
+func (r *RenormReport) add(before, after string, changed bool) {
+	r.Rows++
+	if changed {
+		r.Changed++
+		r.Changes[RenormChange{Before: before, After: after}]++
+	}
+}
+
+// SortedChanges returns the value changes, most frequent first.
+func (r *RenormReport) SortedChanges() []RenormChange {
+	changes := make([]RenormChange, 0, len(r.Changes))
+	for c := range r.Changes {
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		ci, cj := r.Changes[changes[i]], r.Changes[changes[j]]
+		if ci != cj {
+			return ci > cj
+		}
+		if changes[i].Before != changes[j].Before {
+			return changes[i].Before < changes[j].Before
+		}
+		return changes[i].After < changes[j].After
+	})
+	return changes
+}
+
+// Write writes a histogram of the value changes in r to w.
+func (r *RenormReport) Write(w io.Writer) error {
+	fmt.Fprintf(w, "%s: %d of %d rows changed\n", r.Name, r.Changed, r.Rows)
+	if r.Changed == 0 {
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BEFORE\tAFTER\tROWS")
+	changes := r.SortedChanges()
+	for i, c := range changes {
+		if i == renormHistogramSize {
+			fmt.Fprintf(tw, "...\t...\t(%d more)\n", len(changes)-i)
+			break
+		}
+		fmt.Fprintf(tw, "%q\t%q\t%d\n", c.Before, c.After, r.Changes[c])
+	}
+	return tw.Flush()
+}
+
+// A renormTarget is a table updated by a Renormalizer.
+type renormTarget struct {
+	table string
+
+	// query selects id, the stored column value as text, the current
+	// value and the inputs of rows with id > $1, ordered by id; binds are
+	// the binds that follow $1.
+	query string
+	binds []interface{}
+
+	// column is the column updated, with values cast to columnType.
+	column     string
+	columnType string
+
+	// lookup resolves new values to ids when column references a lookup
+	// table.
+	lookup        *loader.TableLookup
+	caseSensitive bool
+}
+
+// renormTargets returns the tables that r updates in sch.
+func renormTargets(sch *cdb.CrawlSchema, r *Renormalizer) ([]*renormTarget, error) {
+	tables := sch.PrefixedTablesWithField(r.Field)
+	if len(tables) == 0 {
+		for _, lt := range sch.LookupTables {
+			if f := lt.FindField(r.Field); f != nil && f != lt.LookupField() {
+				t, err := lookupRenormTarget(lt, r)
+				if err != nil {
+					return nil, err
+				}
+				return []*renormTarget{t}, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: no table has field %s", r.Name, r.Field)
+	}
+
+	res := make([]*renormTarget, len(tables))
+	for i, t := range tables {
+		target, err := factRenormTarget(sch, t, r)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = target
+	}
+	return res, nil
+}
+
+// factRenormTarget builds the target for a game or milestone table, joining
+// the lookup tables of the fields r reads.
+func factRenormTarget(sch *cdb.CrawlSchema, t *cdb.CrawlTable, r *Renormalizer) (*renormTarget, error) {
+	var joins bytes.Buffer
+	joined := map[string]string{}
+	fieldExpr := func(name string) (string, error) {
+		if expr, ok := joined[name]; ok {
+			return expr, nil
+		}
+		f := t.FindField(name)
+		if f == nil {
+			return "", fmt.Errorf("%s: table %s has no field %s", r.Name, t.Name, name)
+		}
+		expr := "t." + f.SQLName
+		if f.ForeignKeyLookup {
+			alias := "j" + strconv.Itoa(len(joined))
+			joins.WriteString(" join " + f.ForeignKeyTable + " as " + alias +
+				" on t." + f.RefName() + " = " + alias + ".id")
+			expr = alias + "." + f.SQLName
+		}
+		joined[name] = expr
+		return expr, nil
+	}
+
+	field := t.FindField(r.Field)
+	if field == nil {
+		return nil, fmt.Errorf("%s: table %s has no field %s", r.Name, t.Name, r.Field)
+	}
+	current, err := fieldExpr(r.Field)
+	if err != nil {
+		return nil, err
+	}
+	column := field.SQLName
+	if field.ForeignKeyLookup {
+		column = field.RefName()
+	}
+	columns := []string{"t.id", "t." + column + "::text", current}
+	inputExprs := make([]string, 0, len(r.inputs()))
+	for _, input := range r.inputs() {
+		expr, err := fieldExpr(input)
+		if err != nil {
+			return nil, err
+		}
+		inputExprs = append(inputExprs, expr)
+	}
+	columns = append(columns, inputExprs...)
+
+	binder := pg.NewBinder()
+	binder.Next()
+	where := []string{"t.id > $1"}
+	binds := []interface{}{}
+	for _, field := range sortedKeys(r.Where) {
+		expr, err := fieldExpr(field)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, expr+" = "+binder.Next())
+		binds = append(binds, r.Where[field])
+	}
+	if r.Prefilter != nil {
+		cond, condBinds := r.Prefilter(inputExprs, binder)
+		where = append(where, "("+cond+")")
+		binds = append(binds, condBinds...)
+	}
+
+	target := &renormTarget{
+		table: t.Name,
+		query: "select " + strings.Join(columns, ", ") + " from " + t.Name + " as t" +
+			joins.String() + " where " + strings.Join(where, " and ") +
+			" order by t.id limit " + strconv.Itoa(renormBatchSize),
+		binds: binds,
+	}
+	if field.ForeignKeyLookup {
+		lt := sch.FindLookupTableForField(field.Name)
+		if lt == nil {
+			return nil, fmt.Errorf("%s: no lookup table for %s", r.Name, field.Name)
+		}
+		// New lookup rows would need the values derived from their
+		// lookup value, which only the loader's normalizer computes.
+		if len(lt.DerivedFields) > 0 {
+			return nil, fmt.Errorf("%s: cannot renormalize %s: lookup table %s has derived fields", r.Name, field.Name, lt.TableName())
+		}
+		target.column, target.columnType = column, "int"
+		target.lookup = loader.NewTableLookup(lt, renormBatchSize)
+		target.caseSensitive = lt.CaseSensitive()
+	} else {
+		target.column, target.columnType = column, field.SQLType
+		target.caseSensitive = true
+	}
+	return target, nil
+}
+
+// lookupRenormTarget builds the target for a column derived from the value of
+// lookup table lt.
+func lookupRenormTarget(lt *cdb.LookupTable, r *Renormalizer) (*renormTarget, error) {
+	field := lt.FindField(r.Field)
+	columns := []string{"t.id", "t." + field.SQLName + "::text", "t." + field.SQLName}
+	for _, input := range r.inputs() {
+		f := lt.FindField(input)
+		if f == nil {
+			return nil, fmt.Errorf("%s: table %s has no field %s", r.Name, lt.TableName(), input)
+		}
+		columns = append(columns, "t."+f.SQLName)
+	}
+	if len(r.Where) > 0 || r.Prefilter != nil {
+		return nil, fmt.Errorf("%s: conditions are not supported on lookup table %s", r.Name, lt.TableName())
+	}
+	return &renormTarget{
+		table: lt.TableName(),
+		query: "select " + strings.Join(columns, ", ") + " from " + lt.TableName() +
+			" as t where t.id > $1 order by t.id limit " + strconv.Itoa(renormBatchSize),
+		column:        field.SQLName,
+		columnType:    field.SQLType,
+		caseSensitive: true,
+	}, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// renormUpdateQuery builds the statement that sets column for nrows rows of
+// table, given binds of row id and new value.
+func renormUpdateQuery(table, column, columnType string, nrows int) string {
+	buf := bytes.Buffer{}
+	buf.WriteString("update " + table + " as t set " + column + " = c.v from (values ")
+	binder := pg.NewBinder()
+	for i := 0; i < nrows; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("(" + binder.Next() + "::bigint," + binder.Next() + "::" + columnType + ")")
+	}
+	buf.WriteString(") as c (id, v) where t.id = c.id")
+	return buf.String()
+}
+
+// A renormRow is a row whose value changes from old to new. stored is the
+// value of the updated column before the change.
+type renormRow struct {
+	id       int64
+	stored   sql.NullString
+	old, new string
+}
+
+// renormalizeTarget applies r to target in batches, adding the changes to
+// report and recording them in run. If run is nil, the changes are only
+// reported.
+func renormalizeTarget(ctx context.Context, c pg.DB, target *renormTarget, r *Renormalizer, report *RenormReport, run *fixRun) error {
+	log.Printf("%s: scanning %s.%s\n", r.Name, target.table, target.column)
+	ninputs := len(r.inputs())
+	values := make([]sql.NullString, ninputs+2)
+	dest := make([]interface{}, ninputs+3)
+	for i := range values {
+		dest[i+1] = &values[i]
+	}
+	inputs := make([]string, ninputs)
+	normalized := map[string]string{}
+
+	var lastID int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows, err := c.QueryContext(ctx, target.query, append([]interface{}{lastID}, target.binds...)...)
+		if err != nil {
+			return errors.Wrapf(err, "%s: query %s", r.Name, target.table)
+		}
+		nrows := 0
+		changed := []renormRow{}
+		for rows.Next() {
+			var id int64
+			dest[0] = &id
+			if err = rows.Scan(dest...); err != nil {
+				rows.Close()
+				return err
+			}
+			nrows++
+			lastID = id
+			for i := range inputs {
+				inputs[i] = values[i+2].String
+			}
+			key := strings.Join(inputs, "\x00")
+			newValue, ok := normalized[key]
+			if !ok {
+				if newValue, err = r.Normalize(inputs); err != nil {
+					rows.Close()
+					return errors.Wrapf(err, "%s: %s id=%d", r.Name, target.table, id)
+				}
+				normalized[key] = newValue
+			}
+			old := values[1].String
+			isChanged := !renormEqual(old, newValue, target.caseSensitive)
+			report.add(old, newValue, isChanged)
+			if isChanged {
+				changed = append(changed, renormRow{id: id, stored: values[0], old: old, new: newValue})
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		if run != nil && len(changed) > 0 {
+			if err = updateRenormRows(ctx, c, target, changed, run); err != nil {
+				return errors.Wrapf(err, "%s: update %s", r.Name, target.table)
+			}
+		}
+		if nrows < renormBatchSize {
+			return nil
+		}
+		if len(normalized) > renormBatchSize*10 {
+			normalized = map[string]string{}
+		}
+	}
+}
+
+// renormEqual checks if old and new are the same value once stored.
+func renormEqual(old, new string, caseSensitive bool) bool {
+	return loader.LookupKey(old, caseSensitive) == loader.LookupKey(new, caseSensitive)
+}
+
+// updateRenormRows sets the changed values of rows in target and records the
+// changes in run in a single transaction, resolving new lookup values first.
+func updateRenormRows(ctx context.Context, c pg.DB, target *renormTarget, rows []renormRow, run *fixRun) error {
+	tx, err := c.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if target.lookup != nil {
+		for _, row := range rows {
+			target.lookup.AddLookup(row.new, nil)
+		}
+		if err = target.lookup.ResolveQueued(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	binds := make([]interface{}, 0, len(rows)*2)
+	changes := make([]fixChange, 0, len(rows))
+	for _, row := range rows {
+		value := row.new
+		if target.lookup != nil {
+			id, err := target.lookup.ID(row.new)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			value = strconv.Itoa(id)
+		}
+		binds = append(binds, row.id, value)
+		changes = append(changes, fixChange{
+			rowID:    row.id,
+			oldValue: row.stored,
+			newValue: sql.NullString{String: value, Valid: true},
+		})
+	}
+	if _, err = tx.ExecContext(ctx, renormUpdateQuery(target.table, target.column, target.columnType, len(rows)), binds...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = run.record(ctx, tx, target.table, target.column, target.columnType, changes); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// renormalize applies r to every table it targets, and returns a report of
+// the changes. If run is nil, no rows are updated.
+func renormalize(ctx context.Context, c pg.DB, sch *cdb.CrawlSchema, r *Renormalizer, run *fixRun) (*RenormReport, error) {
+	report := newRenormReport(r.Name)
+	targets, err := renormTargets(sch, r)
+	if err != nil {
+		return report, err
+	}
+	for _, target := range targets {
+		if err = renormalizeTarget(ctx, c, target, r, report, run); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// Renormalize recomputes the fields of existing rows in the db using
+// renorms, and prints a histogram of the changed values. Changed values are
+// recorded in the fix audit table under a new fix run, so that they can be
+// undone with UndoFixRun. If dryRun is set, the changes are reported, but
+// not made.
+func Renormalize(ctx context.Context, dbc pg.ConnSpec, renorms []*Renormalizer, dryRun bool) error {
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if !dryRun {
+		if err := action.DBLock.Lock(false); err != nil {
+			return err
+		}
+		defer action.DBLock.Unlock()
+	}
+
+	var run *fixRun
+	if !dryRun {
+		if run, err = startFixRun(ctx, c, strings.Join(os.Args, " ")); err != nil {
+			return err
+		}
+	}
+
+	sch := CrawlSchema()
+	for _, r := range renorms {
+		report, err := renormalize(ctx, c, sch, r, run)
+		if werr := report.Write(os.Stdout); werr != nil && err == nil {
+			err = werr
+		}
+		if err != nil {
+			if run != nil {
+				fmt.Printf("Changes made so far can be undone with: seqdb fix-undo %d\n", run.id)
+			}
+			return err
+		}
+	}
+	if run == nil {
+		fmt.Println("Dry run: no rows were updated")
+	} else {
+		fmt.Printf("Fix run %d; undo with: seqdb fix-undo %d\n", run.id, run.id)
+	}
+	return nil
+}
+
+// RenormalizeFields renormalizes the named fields or renormalizers; see
+// FindRenormalizers.
+func RenormalizeFields(ctx context.Context, dbc pg.ConnSpec, names []string, dryRun bool) error {
+	renorms, err := FindRenormalizers(names)
+	if err != nil {
+		return err
+	}
+	return Renormalize(ctx, dbc, renorms, dryRun)
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/crawl/go-sequell/crawl/player"
+	"github.com/crawl/go-sequell/pg"
+)
+
+func TestRenormReport(t *testing.T) {
+	report := newRenormReport("place")
+	report.add("Vault:1", "Vaults:1", true)
+	report.add("D:3", "D:3", false)
+	report.add("Vault:2", "Vaults:2", true)
+	report.add("Vault:1", "Vaults:1", true)
+
+	buf := bytes.Buffer{}
+	if err := report.Write(&buf); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expected := `place: 3 of 4 rows changed
+BEFORE     AFTER       ROWS
+"Vault:1"  "Vaults:1"  2
+"Vault:2"  "Vaults:2"  1
+`
+	if buf.String() != expected {
+		t.Errorf("report:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRenormUpdateQuery(t *testing.T) {
+	query := renormUpdateQuery("milestone", "noun_id", "int", 2)
+	expected := "update milestone as t set noun_id = c.v from (values ($1::bigint,$2::int),($3::bigint,$4::int)) as c (id, v) where t.id = c.id"
+	if query != expected {
+		t.Errorf("renormUpdateQuery = %#v, expected %#v", query, expected)
+	}
+}
+
+func TestMismatchedCharCondition(t *testing.T) {
+	norm := player.NewCharNormalizer(
+		map[interface{}]interface{}{"Te": "Tengu"},
+		map[interface{}]interface{}{"CK": "Chaos Knight"})
+	binder := pg.NewBinder()
+	binder.Next()
+	cond, binds := mismatchedCharCondition(norm, "r.crace", "c.cls", "ch.charabbrev", binder)
+	expected := "(r.crace = $2 and lower(substr(ch.charabbrev, 1, 2)) != $3) or (c.cls = $4 and lower(substr(ch.charabbrev, 3, 2)) != $5)"
+	if cond != expected {
+		t.Errorf("mismatchedCharCondition = %#v, expected %#v", cond, expected)
+	}
+	if expectedBinds := []interface{}{"Tengu", "te", "Chaos Knight", "ck"}; !reflect.DeepEqual(binds, expectedBinds) {
+		t.Errorf("binds = %#v, expected %#v", binds, expectedBinds)
+	}
+}
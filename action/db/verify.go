@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/crawl/go-sequell/action"
+	"github.com/crawl/go-sequell/pg"
+)
+
+// Verify compares the rows in the db with the cached xlogs they were loaded
+// from, for the files in l_file matching globs (or all files, if globs is
+// empty), and reports missing, extra and changed rows. If repair is set,
+// rows missing from the db are inserted. Verify fails if any file does not
+// match the db.
+func Verify(ctx context.Context, dbc pg.ConnSpec, globs []string, repair bool) error {
+	c, err := dbc.Open()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if repair {
+		if err := action.DBLock.Lock(false); err != nil {
+			return err
+		}
+		defer action.DBLock.Unlock()
+	}
+
+	files, err := matchLoadedFiles(ctx, c, globs)
+	if err != nil {
+		return err
+	}
+	ldr := newLoader(c, Sources())
+	defer ldr.Close()
+	filenames := sourceFilenames(ldr)
+
+	mismatched := 0
+	for _, file := range files {
+		filename, ok := filenames[file]
+		if !ok {
+			log.Printf("Skipping %s: no source\n", file)
+			continue
+		}
+		res, err := ldr.VerifyFile(ctx, filename, repair)
+		if res != nil {
+			res.Write(os.Stdout)
+		}
+		if err != nil {
+			return err
+		}
+		if !res.OK() {
+			mismatched++
+		}
+	}
+	if mismatched > 0 {
+		return fmt.Errorf("%d of %d files do not match the db", mismatched, len(files))
+	}
+	return nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 
@@ -61,6 +66,9 @@ func main() {
 		}
 	}()
 	app.Execute()
+	if cmdError != nil {
+		os.Exit(1)
+	}
 }
 
 func defineAppFlags(app *cobra.Command) {
@@ -80,6 +88,23 @@ func reportError(err error) {
 	}
 }
 
+// interruptContext returns a context that is cancelled when seqdb receives
+// SIGINT or SIGTERM, so that the command can stop cleanly. A second signal
+// exits immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, stopping (repeat to exit immediately)\n", sig)
+		cancel()
+		<-signals
+		os.Exit(1)
+	}()
+	return ctx
+}
+
 func fatal(msg string) {
 	fmt.Fprintln(os.Stderr, msg)
 	os.Exit(1)
@@ -96,6 +121,10 @@ func dropFlags(f *pflag.FlagSet) {
 	f.Bool("terminate", false, "terminate other sessions connected to the database")
 }
 
+func dryRunFlag(f *pflag.FlagSet) {
+	f.Bool("dry-run", false, "report the changes without updating the database")
+}
+
 func adminDBSpec(c *cobra.Command) pg.ConnSpec {
 	return pg.ConnSpec{
 		Database: stringFlag(c, "admindb"),
@@ -143,6 +172,22 @@ func intFlag(cmd *cobra.Command, name string) int {
 	return val
 }
 
+func int64Flag(cmd *cobra.Command, name string) int64 {
+	val, err := cmd.Flags().GetInt64(name)
+	if err != nil {
+		fatal("bad int value for " + name + ": " + err.Error())
+	}
+	return val
+}
+
+func durationFlag(cmd *cobra.Command, name string) time.Duration {
+	val, err := cmd.Flags().GetDuration(name)
+	if err != nil {
+		fatal("bad duration value for " + name + ": " + err.Error())
+	}
+	return val
+}
+
 func defineCommands(app *cobra.Command) {
 	app.AddCommand(&cobra.Command{
 		Use:   "version",
@@ -168,27 +213,58 @@ func defineCommands(app *cobra.Command) {
 		Use:   "fetch",
 		Short: "download logs from all sources",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(action.DownloadLogs(boolFlag(c, "only-live"), args))
+			reportError(action.DownloadLogs(interruptContext(), boolFlag(c, "only-live"), args))
 		},
 	}))
 
 	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
-		f.String("force-source-dir", "", "Forces the loader to use the files in the directory specified, associating them with appropriate servers (for test data)")
+		f.String("force-source-dir", "", "Forces the loader to use the files in the directory specified, associating them with appropriate servers (for test data); .gz, .bz2 and .xz files are read directly")
+		f.IntP("jobs", "j", 1, "number of log files to load in parallel")
+		f.String("on-rewrite", "stop", "what to do with files rewritten since they were loaded: stop, reload or skip")
+		f.Bool("dry-run", false, "write the normalized rows that would be loaded to stdout instead of loading them; needs no db")
+		f.String("format", "jsonl", "with --dry-run, the row format: jsonl or csv")
+		f.Int64("from-offset", 0, "with --dry-run, read each log from this offset, which must be the start of a line")
+		f.Int64("to-offset", 0, "with --dry-run, stop reading each log at this offset; 0 reads to the end")
 	}, &cobra.Command{
 		Use:   "load",
 		Short: "load all outstanding data in the logs to the db",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.LoadLogs(dbSpec(c), stringFlag(c, "force-source-dir")))
+			if boolFlag(c, "dry-run") {
+				reportError(db.DryRunLoad(interruptContext(), stringFlag(c, "force-source-dir"),
+					stringFlag(c, "format"), int64Flag(c, "from-offset"), int64Flag(c, "to-offset")))
+				return
+			}
+			if int64Flag(c, "from-offset") != 0 || int64Flag(c, "to-offset") != 0 {
+				fatal("--from-offset and --to-offset require --dry-run")
+			}
+			reportError(db.LoadLogs(interruptContext(), dbSpec(c), stringFlag(c, "force-source-dir"),
+				intFlag(c, "jobs"), stringFlag(c, "on-rewrite")))
 		},
 	}))
 
-	app.AddCommand(&cobra.Command{
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.String("on-rewrite", "stop", "what to do with files rewritten since they were loaded: stop, reload or skip")
+		f.String("control", "", "serve the HTTP control API on host:port (:port listens on localhost) or unix:/path/to/socket")
+		f.String("control-token", os.Getenv("SEQUELL_CONTROL_TOKEN"), "require this bearer token on control API requests; needed to listen on hosts other than localhost")
+		f.Duration("fetch-interval", 0, "fetch live logs at this interval (e.g. 5m) from servers without a fetch-interval in sources.yml; 0 fetches only on request")
+		f.Duration("poll-interval", 0, "poll log directories for changes at this interval (e.g. 10s) instead of using inotify; use on NFS or FUSE mounts")
+		f.Bool("daemon", false, "ignore stdin and run until SIGTERM; SIGHUP reloads config and SIGUSR1 fetches logs (does not fork)")
+		f.String("pidfile", "", "lock this file and write the isync pid to it while running")
+	}, &cobra.Command{
 		Use:   "isync",
 		Short: "load all data, then run an interactive process that accepts commands to \"fetch\" on stdin, automatically loading logs that are updated",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(action.Isync(dbSpec(c)))
+			reportError(action.Isync(interruptContext(), dbSpec(c), action.IsyncOptions{
+				OnRewrite:       stringFlag(c, "on-rewrite"),
+				ControlAddr:     stringFlag(c, "control"),
+				ControlToken:    stringFlag(c, "control-token"),
+				FetchInterval:   durationFlag(c, "fetch-interval"),
+				LogPollInterval: durationFlag(c, "poll-interval"),
+				Daemon:          boolFlag(c, "daemon"),
+				PidFile:         stringFlag(c, "pidfile"),
+			}))
 		},
-	})
+	}))
 	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
 		f.Bool("no-index", false, "table drop+create DDL only; no indexes and constraints")
 		f.Bool("drop-index", false, "DDL to drop indexes and constraints only; no tables")
@@ -218,14 +294,81 @@ func defineCommands(app *cobra.Command) {
 		},
 	})
 	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
-		f.Bool("upgrade", false, "apply any changes to the DB (not implemented)")
+		f.Bool("upgrade", false, "add missing tables, columns, indexes and constraints to the DB")
+		f.Bool("dry-run", false, "with --upgrade, print the upgrade DDL instead of applying it")
 	}, &cobra.Command{
 		Use:   "checkdb",
 		Short: "check the DB schema for correctness",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.CheckDBSchema(dbSpec(c), boolFlag(c, "upgrade")))
+			reportError(db.CheckDBSchema(dbSpec(c), boolFlag(c, "upgrade"),
+				boolFlag(c, "dry-run")))
+		},
+	}))
+	migrate := &cobra.Command{
+		Use:   "migrate",
+		Short: "apply, show or revert the schema changes applied to the DB",
+	}
+	migrate.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("dry-run", false, "print the upgrade DDL instead of applying it")
+	}, &cobra.Command{
+		Use:   "up",
+		Short: "add missing tables, columns, indexes and constraints to the DB (same as checkdb --upgrade)",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.CheckDBSchema(dbSpec(c), true, boolFlag(c, "dry-run")))
 		},
 	}))
+	migrate.AddCommand(&cobra.Command{
+		Use:   "status",
+		Short: "show the DB schema revision and the history of applied schema changes",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.MigrationStatus(dbSpec(c)))
+		},
+	})
+	migrate.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("force", false, "actually revert the schema change")
+	}, &cobra.Command{
+		Use:   "rollback",
+		Short: "revert the most recent schema change (must use --force)",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.RollbackMigration(dbSpec(c), boolFlag(c, "force")))
+		},
+	}))
+	app.AddCommand(migrate)
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.String("old", "", "the old crawl-data.yml to compare with the current one (required)")
+		f.Int("sample", 0, "compare N xlogs picked at random from each log; 0 compares all")
+	}, &cobra.Command{
+		Use:   "norm-diff",
+		Short: "show the xlog fields that normalize differently with the current crawl-data.yml than with an old one",
+		Run: func(c *cobra.Command, args []string) {
+			oldPath := stringFlag(c, "old")
+			if oldPath == "" {
+				fatal("norm-diff needs --old crawl-data.yml")
+			}
+			reportError(db.NormDiff(interruptContext(), oldPath, intFlag(c, "sample")))
+		},
+	}))
+	rejects := &cobra.Command{
+		Use:   "rejects",
+		Short: "show or retry xlog lines that could not be loaded",
+	}
+	rejects.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("lines", false, "show the text of each rejected line")
+	}, &cobra.Command{
+		Use:   "list [file...]",
+		Short: "list rejected xlog lines, optionally only from the given files",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.ListRejects(context.Background(), dbSpec(c), args, boolFlag(c, "lines")))
+		},
+	}))
+	rejects.AddCommand(&cobra.Command{
+		Use:   "retry [file...]",
+		Short: "load the rejected xlog lines that the current parser and normalizer accept",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.RetryRejects(interruptContext(), dbSpec(c), args))
+		},
+	})
+	app.AddCommand(rejects)
 	app.AddCommand(setFlags(adminFlags, &cobra.Command{
 		Use:   "newdb",
 		Short: "create the Sequell database and initialize it",
@@ -283,13 +426,25 @@ func defineCommands(app *cobra.Command) {
 			reportError(db.CreateIndexes(dbSpec(c)))
 		},
 	})
-	app.AddCommand(&cobra.Command{
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.String("server", "", "list only files from this server")
+		f.String("game", "", "list only files of this game type")
+		f.Bool("backlog", false, "list only files with data on disk that is not loaded yet")
+		f.Bool("json", false, "list files as JSON")
+		f.Bool("recount", false, "recount the rows and row times of all files before listing them (slow)")
+	}, &cobra.Command{
 		Use:   "ls-files",
-		Short: "lists all files known to Sequell",
+		Short: "lists all files known to Sequell, with their sources, backlogs and rows loaded",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.ListFiles(dbSpec(c)))
+			reportError(db.ListFiles(interruptContext(), dbSpec(c), db.FileListOptions{
+				Server:  stringFlag(c, "server"),
+				Game:    stringFlag(c, "game"),
+				Backlog: boolFlag(c, "backlog"),
+				JSON:    boolFlag(c, "json"),
+				Recount: boolFlag(c, "recount"),
+			}))
 		},
-	})
+	}))
 	app.AddCommand(&cobra.Command{
 		Use:   "rm-file",
 		Short: "deletes rows inserted from the specified file(s)",
@@ -297,6 +452,24 @@ func defineCommands(app *cobra.Command) {
 			reportError(db.DeleteFileRows(dbSpec(c), args))
 		},
 	})
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("dry-run", false, "show the rows now loaded from each file and the rows a reload would load")
+	}, &cobra.Command{
+		Use:   "reload-file <file-glob>...",
+		Short: "delete the rows loaded from files matching the globs (where * also matches /) and load them again with the current normalizer",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.ReloadFiles(interruptContext(), dbSpec(c), args, boolFlag(c, "dry-run")))
+		},
+	}))
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("repair", false, "insert the rows missing from the db")
+	}, &cobra.Command{
+		Use:   "verify [file-glob...]",
+		Short: "compare the rows in the db with the cached xlogs they were loaded from, for all files or those matching the globs (where * also matches /); reads each file's db rows into memory",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.Verify(interruptContext(), dbSpec(c), args, boolFlag(c, "repair")))
+		},
+	}))
 	app.AddCommand(&cobra.Command{
 		Use:   "sources",
 		Short: "show all remote source URLs",
@@ -318,21 +491,21 @@ func defineCommands(app *cobra.Command) {
 			reportError(db.ImportTV(dbSpec(c)))
 		},
 	})
-	app.AddCommand(&cobra.Command{
+	app.AddCommand(setFlags(dryRunFlag, &cobra.Command{
 		Use:   "vrenum",
 		Short: "recomputes version numbers for l_version, l_cversion and l_vlong. Use this to update these tables if/when the version number algorithm changes.",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.RenumberVersions(dbSpec(c)))
+			reportError(db.RenumberVersions(interruptContext(), dbSpec(c), boolFlag(c, "dry-run")))
 		},
-	})
-	app.AddCommand(&cobra.Command{
+	}))
+	app.AddCommand(setFlags(dryRunFlag, &cobra.Command{
 		Use:   "fix-char",
 		Short: "fix incorrect `char` fields using crace and cls",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.FixCharFields(dbSpec(c)))
+			reportError(db.FixCharFields(interruptContext(), dbSpec(c), boolFlag(c, "dry-run")))
 		},
-	})
-	app.AddCommand(&cobra.Command{
+	}))
+	app.AddCommand(setFlags(dryRunFlag, &cobra.Command{
 		Use:   "fix-field",
 		Short: "fix incorrect field",
 		Run: func(c *cobra.Command, args []string) {
@@ -340,16 +513,49 @@ func defineCommands(app *cobra.Command) {
 				reportError(fmt.Errorf("field to fix not specified"))
 				return
 			}
-			reportError(db.FixField(dbSpec(c), args[0]))
+			reportError(db.FixField(interruptContext(), dbSpec(c), args[0], boolFlag(c, "dry-run")))
 		},
-	})
-	app.AddCommand(&cobra.Command{
+	}))
+	app.AddCommand(setFlags(dryRunFlag, &cobra.Command{
 		Use:   "fix-god-ecumenical",
 		Short: "fix nouns for god.ecumenical milestones",
 		Run: func(c *cobra.Command, args []string) {
-			reportError(db.FixGodEcumenical(dbSpec(c)))
+			reportError(db.FixGodEcumenical(interruptContext(), dbSpec(c), boolFlag(c, "dry-run")))
+		},
+	}))
+	app.AddCommand(setFlags(dryRunFlag, &cobra.Command{
+		Use:   "renormalize <field>...",
+		Short: "recompute fields of existing rows after crawl-data.yml changes: fields with transforms in crawl-data.yml, or char, god-ecumenical, versions",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) == 0 {
+				fatal("renormalize needs at least one field")
+			}
+			reportError(db.RenormalizeFields(interruptContext(), dbSpec(c), args, boolFlag(c, "dry-run")))
+		},
+	}))
+	app.AddCommand(&cobra.Command{
+		Use:   "fix-runs",
+		Short: "list the recorded runs of data fix commands, which fix-undo can revert",
+		Run: func(c *cobra.Command, args []string) {
+			reportError(db.ListFixRuns(context.Background(), dbSpec(c)))
 		},
 	})
+	app.AddCommand(setFlags(func(f *pflag.FlagSet) {
+		f.Bool("force", false, "restore rows even if they changed after the fix run")
+	}, &cobra.Command{
+		Use:   "fix-undo <run-id>",
+		Short: "restore the values changed by a run of fix-char, fix-field, fix-god-ecumenical, vrenum or renormalize",
+		Run: func(c *cobra.Command, args []string) {
+			if len(args) != 1 {
+				fatal("fix-undo needs a run id; see seqdb fix-runs")
+			}
+			runID, err := strconv.ParseInt(args[0], 10, 64)
+			if err != nil {
+				fatal(fmt.Sprintf("bad run id %#v", args[0]))
+			}
+			reportError(db.UndoFixRun(interruptContext(), dbSpec(c), runID, boolFlag(c, "force")))
+		},
+	}))
 	app.AddCommand(&cobra.Command{
 		Use:   "xlog-link",
 		Short: "link old remote.* to new URL-based paths",
@@ -0,0 +1,80 @@
+// Package compression identifies compressed files by their extensions and
+// decompresses them.
+package compression
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// A Format is a compression format.
+type Format string
+
+// Supported compression formats.
+const (
+	None  Format = ""
+	Gzip  Format = "gzip"
+	Bzip2 Format = "bzip2"
+	Xz    Format = "xz"
+)
+
+// extensions maps filename extensions to the formats they identify.
+var extensions = map[string]Format{
+	".gz":  Gzip,
+	".bz2": Bzip2,
+	".xz":  Xz,
+}
+
+// FilenameFormat returns the compression format of filename, based on its
+// extension, or None if filename is not compressed.
+func FilenameFormat(filename string) Format {
+	return extensions[strings.ToLower(path.Ext(filename))]
+}
+
+// StripExtension returns filename without its compression extension, if it
+// has one.
+func StripExtension(filename string) string {
+	if FilenameFormat(filename) == None {
+		return filename
+	}
+	return strings.TrimSuffix(filename, path.Ext(filename))
+}
+
+// ContentEncodingFormat returns the compression format for an HTTP
+// Content-Encoding, or None if the encoding is identity or unsupported.
+func ContentEncodingFormat(encoding string) Format {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return Gzip
+	default:
+		return None
+	}
+}
+
+// NewReader returns a reader that decompresses r in format f. If f is None,
+// the reader returns r's bytes unchanged. Closing the reader does not close r.
+func NewReader(f Format, r io.Reader) (io.ReadCloser, error) {
+	switch f {
+	case None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case Xz:
+		xzr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzr), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression format %q", string(f))
+	}
+}
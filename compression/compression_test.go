@@ -0,0 +1,74 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestFilenameFormat(t *testing.T) {
+	tests := []struct {
+		filename string
+		format   Format
+		stripped string
+	}{
+		{"logfile", None, "logfile"},
+		{"meta/0.11/logfile", None, "meta/0.11/logfile"},
+		{"logfile.gz", Gzip, "logfile"},
+		{"milestones.BZ2", Bzip2, "milestones"},
+		{"logfile-0.10.xz", Xz, "logfile-0.10"},
+		{"logfile.txt", None, "logfile.txt"},
+	}
+	for _, test := range tests {
+		if f := FilenameFormat(test.filename); f != test.format {
+			t.Errorf("FilenameFormat(%#v) = %#v, want %#v", test.filename, f, test.format)
+		}
+		if s := StripExtension(test.filename); s != test.stripped {
+			t.Errorf("StripExtension(%#v) = %#v, want %#v", test.filename, s, test.stripped)
+		}
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	const text = "name=hugeterm:xl=27:sc=1234\n"
+
+	gz := bytes.Buffer{}
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write([]byte(text))
+	gzw.Close()
+
+	xzb := bytes.Buffer{}
+	xzw, err := xz.NewWriter(&xzb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xzw.Write([]byte(text))
+	xzw.Close()
+
+	for _, test := range []struct {
+		format Format
+		data   []byte
+	}{
+		{None, []byte(text)},
+		{Gzip, gz.Bytes()},
+		{Xz, xzb.Bytes()},
+	} {
+		r, err := NewReader(test.format, bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("NewReader(%#v): %s", test.format, err)
+			continue
+		}
+		res, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(res) != text {
+			t.Errorf("NewReader(%#v) read %#v, %v; want %#v", test.format, string(res), err, text)
+		}
+	}
+
+	if _, err := NewReader("zip", bytes.NewReader(nil)); err == nil {
+		t.Errorf("NewReader(zip) succeeded, expected error")
+	}
+}
@@ -69,9 +69,55 @@ func LoadSchema(schemaDef qyaml.YAML) (*CrawlSchema, error) {
 			return nil, err
 		}
 	}
+	schema.addFileMetadataFields()
 	return &schema, nil
 }
 
+// FileLookupTable is the name of the lookup table of xlog files.
+const FileLookupTable = "file"
+
+// fileMetadataFields are the fields of the file lookup table that the loader
+// maintains for its own bookkeeping, in addition to the fields defined in the
+// schema YAML: the checksum of the last line loaded, the source of the file,
+// and the number and time range of the rows loaded from it.
+func fileMetadataFields() []*Field {
+	field := func(name, sqlName, sqlType string) *Field {
+		return &Field{
+			Name:     name,
+			Type:     strings.ToUpper(sqlType),
+			Features: "*&",
+			SQLName:  sqlName,
+			SQLType:  sqlType,
+			External: true,
+		}
+	}
+	return []*Field{
+		field("checksum", "file_checksum", "text"),
+		field("server", "file_server", "text"),
+		field("url", "file_url", "text"),
+		field("game", "file_game", "text"),
+		field("xlog_type", "file_xlog_type", "text"),
+		field("rows", "file_rows", "bigint"),
+		field("first_time", "file_first_time", "timestamp"),
+		field("last_time", "file_last_time", "timestamp"),
+		field("loaded_at", "file_loaded_at", "timestamp"),
+	}
+}
+
+// addFileMetadataFields adds the loader's bookkeeping fields to the file
+// lookup table, if the schema has one.
+func (s *CrawlSchema) addFileMetadataFields() {
+	file := s.LookupTable(FileLookupTable)
+	if file == nil {
+		return
+	}
+	for _, f := range fileMetadataFields() {
+		if file.FindField(f.Name) == nil {
+			file.Fields = append(file.Fields, f)
+		}
+	}
+}
+
 // PrefixedTablesWithField returns the list of tables containing field,
 // prefixing them with their table variant prefixes.
 func (s *CrawlSchema) PrefixedTablesWithField(field string) []*CrawlTable {
@@ -326,7 +372,8 @@ func (s *CrawlSchema) Table(name string) *CrawlTable {
 	return nil
 }
 
-// SchemaTables gets the list of table SQL schema objects.
+// SchemaTables gets the list of table SQL schema objects, including the
+// support tables Sequell uses for its own bookkeeping.
 func (s *CrawlSchema) SchemaTables() []*schema.Table {
 	tables := make([]*schema.Table,
 		len(s.LookupTables)+len(s.Tables)*len(s.TableVariantPrefixes))
@@ -342,7 +389,7 @@ func (s *CrawlSchema) SchemaTables() []*schema.Table {
 		}
 	}
 
-	return tables
+	return append(tables, supportTables()...)
 }
 
 // FindField looks up the field definition given a field name.
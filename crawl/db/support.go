@@ -0,0 +1,85 @@
+package db
+
+import "github.com/crawl/go-sequell/schema"
+
+// RejectsTable is the table of xlog lines that the loader could not load,
+// so that they can be counted and loaded again once the parser or
+// normalizer is fixed.
+const RejectsTable = "rejected_xlog"
+
+// FixRunTable records each run of a data fix command, and FixAuditTable the
+// old and new values of every column the run changed.
+const (
+	FixRunTable   = "fix_run"
+	FixAuditTable = "fix_audit"
+)
+
+// supportTables are the tables Sequell keeps for its own bookkeeping,
+// alongside the game, milestone and lookup tables. They are created and
+// upgraded with the rest of the schema.
+func supportTables() []*schema.Table {
+	rejects := supportTable(RejectsTable,
+		&schema.Column{Name: "id", SQLType: "serial"},
+		&schema.Column{Name: "file", SQLType: "text"},
+		&schema.Column{Name: "src", SQLType: "text"},
+		&schema.Column{Name: "xlog_table", SQLType: "text"},
+		&schema.Column{Name: "file_offset", SQLType: "bigint"},
+		&schema.Column{Name: "line", SQLType: "text"},
+		&schema.Column{Name: "reason", SQLType: "text"},
+		&schema.Column{Name: "rejected_at", SQLType: "timestamp", Default: "default now()"})
+	rejects.Indexes = append(rejects.Indexes,
+		supportIndex(RejectsTable, true, "file", "file_offset"))
+
+	fixRuns := supportTable(FixRunTable,
+		&schema.Column{Name: "id", SQLType: "serial"},
+		&schema.Column{Name: "command", SQLType: "text"},
+		&schema.Column{Name: "started_at", SQLType: "timestamp", Default: "default now()"},
+		&schema.Column{Name: "undone_at", SQLType: "timestamp"})
+
+	fixAudit := supportTable(FixAuditTable,
+		&schema.Column{Name: "id", SQLType: "bigserial"},
+		&schema.Column{Name: "run_id", SQLType: "int"},
+		&schema.Column{Name: "table_name", SQLType: "text"},
+		&schema.Column{Name: "row_id", SQLType: "bigint"},
+		&schema.Column{Name: "column_name", SQLType: "text"},
+		&schema.Column{Name: "column_type", SQLType: "text"},
+		&schema.Column{Name: "old_value", SQLType: "text"},
+		&schema.Column{Name: "new_value", SQLType: "text"})
+	fixAudit.Indexes = append(fixAudit.Indexes,
+		supportIndex(FixAuditTable, false, "run_id"))
+	fixAudit.Constraints = append(fixAudit.Constraints,
+		schema.ForeignKeyConstraint{
+			ConstraintName:   FixAuditTable + "_run_id_fk",
+			SourceTableField: "run_id",
+			TargetTable:      FixRunTable,
+			TargetTableField: "id",
+		})
+
+	return []*schema.Table{rejects, fixRuns, fixAudit}
+}
+
+// supportTable creates the schema for a support table with columns, the
+// first of which is its id primary key.
+func supportTable(name string, columns ...*schema.Column) *schema.Table {
+	return &schema.Table{
+		Name:    name,
+		Columns: columns,
+		Constraints: []schema.Constraint{
+			schema.PrimaryKeyConstraint{
+				ConstraintName: name + "_pk",
+				Column:         columns[0].Name,
+			},
+		},
+	}
+}
+
+// supportIndex creates an index on columns of the support table name.
+func supportIndex(name string, unique bool, columns ...string) *schema.Index {
+	return &schema.Index{
+		Name:      IndexName(name, columns, unique),
+		TableName: name,
+		Columns:   columns,
+		Unique:    unique,
+		Force:     true,
+	}
+}
@@ -32,7 +32,7 @@ func (l *Lock) lockMode(blocking bool) int {
 func (l *Lock) Lock(blocking bool) error {
 	if l.File == nil {
 		var err error
-		l.File, err = os.OpenFile(l.Path, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, 0600)
+		l.File, err = os.OpenFile(l.Path, syscall.O_WRONLY|syscall.O_CREAT, 0600)
 		if err != nil {
 			return errors.Wrapf(err, "open %s", l.Path)
 		}
@@ -41,7 +41,12 @@ func (l *Lock) Lock(blocking bool) error {
 	if err := syscall.Flock(int(l.File.Fd()), l.lockMode(blocking)); err != nil {
 		return errors.Wrapf(err, "flock %s", l.Path)
 	}
-	l.File.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	// The file is truncated only once locked, so that a failed attempt
+	// leaves the lock holder's pid intact:
+	if err := l.File.Truncate(0); err != nil {
+		return errors.Wrapf(err, "truncate %s", l.Path)
+	}
+	l.File.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
 	return nil
 }
 
@@ -1,7 +1,11 @@
 package fnotify
 
 import (
+	"context"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 
 	"gopkg.in/fsnotify.v1"
@@ -13,7 +17,12 @@ type Notifier struct {
 	watcher        *fsnotify.Watcher
 	Debounce       time.Duration
 	RemonitorDelay time.Duration
-	shutdown       chan bool
+
+	// PollInterval, if non-zero, makes the notifier poll files for changes
+	// in size and modification time at this interval instead of using
+	// inotify. Polling works on network and FUSE filesystems, where inotify
+	// events are never delivered.
+	PollInterval time.Duration
 }
 
 const (
@@ -24,6 +33,10 @@ const (
 	// DefaultRemonitorDelay is how long to wait after a file is removed to see
 	// if it will reappear and must be remonitored.
 	DefaultRemonitorDelay = 500 * time.Millisecond
+
+	// DefaultPollInterval is the poll interval used when inotify cannot be
+	// set up and the notifier has no PollInterval.
+	DefaultPollInterval = 5 * time.Second
 )
 
 // New creates a file change notifier named name.
@@ -32,28 +45,28 @@ func New(name string) *Notifier {
 		name:           name,
 		Debounce:       DefaultDebounce,
 		RemonitorDelay: DefaultRemonitorDelay,
-		shutdown:       make(chan bool, 1),
 	}
 }
 
-// Close shuts down the notifier asynchronously.
-func (n *Notifier) Close() error {
-	n.shutdown <- true
-	return nil
-}
-
 // Notify synchronously watches the list of files for changes, writing changed
-// filenames to res. Notify blocks unless monitoring fails, so it must be run in
-// a goroutine.
-func (n *Notifier) Notify(files []string, res chan<- string) error {
+// filenames to res. Directories in files are watched for changes to the files
+// they contain. Notify blocks until ctx is cancelled or monitoring fails, so
+// it must be run in a goroutine.
+//
+// If n.PollInterval is set, or inotify cannot be set up, Notify polls the
+// files for changes instead.
+func (n *Notifier) Notify(ctx context.Context, files []string, res chan<- string) error {
+	if n.PollInterval > 0 {
+		return n.poll(ctx, files, n.PollInterval, res)
+	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		return err
+		return n.fallbackPoll(ctx, files, res, err)
 	}
 	defer watcher.Close()
 	for _, f := range files {
 		if err := watcher.Add(f); err != nil {
-			return err
+			return n.fallbackPoll(ctx, files, res, err)
 		}
 	}
 
@@ -99,10 +112,8 @@ selectLoop:
 				delete(filesToRemonitor, file)
 			}
 		case <-throttleChan():
-			for file := range pendingChanges {
-				delete(pendingChanges, file)
-				log.Println("file changed:", file)
-				res <- file
+			if !n.sendChanges(ctx, pendingChanges, res) {
+				break selectLoop
 			}
 		case err := <-watcher.Errors:
 			if err != nil {
@@ -110,10 +121,116 @@ selectLoop:
 				break
 			}
 			break selectLoop
-		case <-n.shutdown:
+		case <-ctx.Done():
 			break selectLoop
 		}
 	}
 	throttler.Stop()
 	return nil
 }
+
+// fallbackPoll polls files after inotify setup failed with err.
+func (n *Notifier) fallbackPoll(ctx context.Context, files []string, res chan<- string, err error) error {
+	log.Println("watcher", n.name, "cannot use inotify, polling every",
+		DefaultPollInterval, "instead:", err)
+	return n.poll(ctx, files, DefaultPollInterval, res)
+}
+
+// sendChanges writes the pending changed files to res, clearing them,
+// and returns false if ctx was cancelled first.
+func (n *Notifier) sendChanges(ctx context.Context, pendingChanges map[string]bool, res chan<- string) bool {
+	for file := range pendingChanges {
+		delete(pendingChanges, file)
+		log.Println("file changed:", file)
+		select {
+		case res <- file:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// fileState is the state of a polled file that is compared to detect
+// changes.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// poll checks files for changes every interval until ctx is cancelled,
+// writing changed filenames to res, debounced like inotify events.
+func (n *Notifier) poll(ctx context.Context, files []string, interval time.Duration, res chan<- string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	states := pollStates(files)
+	pendingChanges := map[string]bool{}
+	throttler := time.NewTimer(n.Debounce)
+	defer throttler.Stop()
+	throttleChan := func() <-chan time.Time {
+		if len(pendingChanges) == 0 {
+			return nil
+		}
+		return throttler.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			newStates := pollStates(files)
+			changed := false
+			for file, state := range newStates {
+				if old, ok := states[file]; !ok || old != state {
+					pendingChanges[file] = true
+					changed = true
+				}
+			}
+			for file := range states {
+				if _, ok := newStates[file]; !ok {
+					pendingChanges[file] = true
+					changed = true
+				}
+			}
+			states = newStates
+			if changed {
+				throttler.Reset(n.Debounce)
+			}
+		case <-throttleChan():
+			if !n.sendChanges(ctx, pendingChanges, res) {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pollStates returns the states of files that exist, including the files
+// directly inside directories in files.
+func pollStates(files []string) map[string]fileState {
+	states := map[string]fileState{}
+	add := func(file string, fi os.FileInfo) {
+		states[file] = fileState{size: fi.Size(), modTime: fi.ModTime()}
+	}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !fi.IsDir() {
+			add(file, fi)
+			continue
+		}
+		entries, err := ioutil.ReadDir(file)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				add(filepath.Join(file, entry.Name()), entry)
+			}
+		}
+	}
+	return states
+}
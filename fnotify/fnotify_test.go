@@ -0,0 +1,70 @@
+package fnotify
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func expectChange(t *testing.T, res <-chan string, expected string) {
+	t.Helper()
+	select {
+	case file := <-res:
+		if file != expected {
+			t.Errorf("changed file %#v, expected %#v", file, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("no change notification for %#v", expected)
+	}
+}
+
+func TestNotifyPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fnotify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logfile := filepath.Join(dir, "logfile")
+	if err := ioutil.WriteFile(logfile, []byte("v=0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	n := New("test")
+	n.PollInterval = 10 * time.Millisecond
+	n.Debounce = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- n.Notify(ctx, []string{dir}, res)
+	}()
+	// Let the notifier record the existing logfile:
+	time.Sleep(50 * time.Millisecond)
+
+	f, err := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("v=0.2\n")
+	f.Close()
+	expectChange(t, res, logfile)
+
+	milestones := filepath.Join(dir, "milestones")
+	if err := ioutil.WriteFile(milestones, []byte("v=0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange(t, res, milestones)
+
+	os.Remove(logfile)
+	expectChange(t, res, logfile)
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Notify failed: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package httpfetch
+
+import (
+	"fmt"
+	"time"
+)
+
+// A HostSuspendedError is the error for requests to a host that has been
+// suspended by its circuit breaker after repeated failures.
+type HostSuspendedError struct {
+	Host  string
+	Until time.Time
+}
+
+func (err *HostSuspendedError) Error() string {
+	return fmt.Sprintf("%s suspended until %s after repeated failures",
+		err.Host, err.Until.Format(time.RFC3339))
+}
+
+// A hostBreaker is the circuit breaker for a single host. After threshold
+// consecutive failed fetches, the breaker trips, and requests to the host
+// fail immediately until the cooldown has passed. A single probe request is
+// then allowed through: if it succeeds, the breaker resets; if it fails, the
+// host is suspended for another cooldown.
+//
+// hostBreaker is used only by the host queue monitor goroutine, and is not
+// safe for concurrent use.
+type hostBreaker struct {
+	host      string
+	threshold int
+	cooldown  time.Duration
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newHostBreaker(host string, threshold int, cooldown time.Duration) *hostBreaker {
+	return &hostBreaker{host: host, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *hostBreaker) tripped() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// suspended returns an error if requests to the host must fail immediately
+// at now.
+func (b *hostBreaker) suspended(now time.Time) error {
+	if b.tripped() && now.Before(b.openUntil) {
+		return &HostSuspendedError{Host: b.host, Until: b.openUntil}
+	}
+	return nil
+}
+
+// canDispatch returns true if a request may be sent to the host at now.
+func (b *hostBreaker) canDispatch(now time.Time) bool {
+	return !b.tripped() || (!now.Before(b.openUntil) && !b.probing)
+}
+
+// dispatched records that a request was sent to the host.
+func (b *hostBreaker) dispatched() {
+	if b.tripped() {
+		b.probing = true
+	}
+}
+
+// record records the outcome of a request to the host. hostFailure is true
+// if the request failed because the host is unreachable or failing.
+func (b *hostBreaker) record(hostFailure bool, now time.Time) {
+	b.probing = false
+	if !hostFailure {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.tripped() {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
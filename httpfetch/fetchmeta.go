@@ -0,0 +1,98 @@
+package httpfetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// FileMeta is the HTTP cache validator metadata for a downloaded file, saved
+// in a sidecar file next to the download.
+type FileMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// MetaPath returns the path of the sidecar metadata file for filename: a
+// hidden file in the same directory.
+func MetaPath(filename string) string {
+	dir, base := filepath.Split(filename)
+	return filepath.Join(dir, "."+base+".fetchmeta")
+}
+
+// IsMetaPath returns true if path is a sidecar metadata file.
+func IsMetaPath(path string) bool {
+	base := filepath.Base(path)
+	return len(base) > len(".fetchmeta") && base[0] == '.' &&
+		filepath.Ext(base) == ".fetchmeta"
+}
+
+// ReadFileMeta reads the metadata saved for filename, returning nil if there
+// is no (readable) metadata.
+func ReadFileMeta(filename string) *FileMeta {
+	text, err := ioutil.ReadFile(MetaPath(filename))
+	if err != nil {
+		return nil
+	}
+	var meta FileMeta
+	if err = json.Unmarshal(text, &meta); err != nil {
+		return nil
+	}
+	return &meta
+}
+
+// WriteFileMeta saves meta for filename.
+func WriteFileMeta(filename string, meta *FileMeta) error {
+	text, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	metaPath := MetaPath(filename)
+	tmp := metaPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, text, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath)
+}
+
+// RemoveFileMeta deletes the metadata saved for filename, if any.
+func RemoveFileMeta(filename string) error {
+	err := os.Remove(MetaPath(filename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// responseFileMeta returns the validators in resp for url, or nil if resp
+// has no validators.
+func responseFileMeta(url string, resp *http.Response) *FileMeta {
+	meta := &FileMeta{
+		URL:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if meta.ETag == "" && meta.LastModified == "" {
+		return nil
+	}
+	return meta
+}
+
+// conditionalHeaders returns a copy of headers with If-None-Match and
+// If-Modified-Since headers added if meta has validators for url.
+func (meta *FileMeta) conditionalHeaders(url string, headers Headers) Headers {
+	if meta == nil || meta.URL != url {
+		return headers
+	}
+	headers = headers.Copy()
+	if meta.ETag != "" {
+		headers["If-None-Match"] = meta.ETag
+	}
+	if meta.LastModified != "" {
+		headers["If-Modified-Since"] = meta.LastModified
+	}
+	return headers
+}
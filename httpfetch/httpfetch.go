@@ -1,14 +1,21 @@
 package httpfetch
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/crawl/go-sequell/compression"
 )
 
 // DefaultUserAgent is the HTTP user agent string.
@@ -22,14 +29,30 @@ type Fetcher struct {
 	UserAgent                    string
 	MaxConcurrentRequestsPerHost int
 
-	// Queues for each host, monitored by the service goroutine.
+	// OnResult, if set, is called with the result of every fetch. OnResult
+	// may be called concurrently for requests to different hosts.
+	OnResult func(*FetchResult)
+
+	// Retry is the policy for retrying failed fetches.
+	Retry RetryPolicy
+
+	// After BreakerThreshold consecutive fetches from a host fail (after
+	// retries) with retryable errors, the host is suspended for
+	// BreakerCooldown, and requests to it fail immediately. If
+	// BreakerThreshold is 0, hosts are never suspended.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Queues for each host, monitored by the service goroutine, and
+	// guarded by hostMutex so that fetches may be queued concurrently.
+	hostMutex        sync.Mutex
 	hostQueues       map[string]chan<- *FetchRequest
 	hostWaitGroup    sync.WaitGroup
 	enqueueWaitGroup sync.WaitGroup
 }
 
-// New returns a new Fetcher for parallel downloads. Fetcher
-// methods are not threadsafe.
+// New returns a new Fetcher for parallel downloads. Fetch and QueueFetch
+// may be called concurrently; other Fetcher methods are not threadsafe.
 func New() *Fetcher {
 	return &Fetcher{
 		HTTPClient:                   DefaultHTTPClient,
@@ -37,6 +60,9 @@ func New() *Fetcher {
 		ReadTimeout:                  DefaultReadTimeout,
 		UserAgent:                    DefaultUserAgent,
 		MaxConcurrentRequestsPerHost: 5,
+		Retry:                        DefaultRetryPolicy,
+		BreakerThreshold:             DefaultBreakerThreshold,
+		BreakerCooldown:              DefaultBreakerCooldown,
 		hostQueues:                   map[string]chan<- *FetchRequest{},
 	}
 }
@@ -48,6 +74,13 @@ var (
 	// DefaultReadTimeout is how long to wait for a HTTP read to timeout.
 	DefaultReadTimeout = 20 * time.Second
 
+	// DefaultBreakerThreshold is the number of consecutive failed fetches
+	// after which a host is suspended.
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is how long a failing host is suspended.
+	DefaultBreakerCooldown = 10 * time.Minute
+
 	// DefaultHTTPTransport is the default transport to use for HTTP requests
 	DefaultHTTPTransport = http.Transport{
 		Dial:                  dialer(DefaultConnectTimeout, DefaultReadTimeout),
@@ -91,6 +124,14 @@ type FetchRequest struct {
 	// Don't try to resume downloads if this is set.
 	FullDownload   bool
 	RequestHeaders Headers
+
+	// Compression is the compression format of the remote file, which is
+	// decompressed into Filename. Compressed files are always downloaded in
+	// full.
+	Compression compression.Format
+
+	// batch, if set, receives the result of the request.
+	batch *fetchBatch
 }
 
 // Host gets the HTTP host to make the request to
@@ -111,10 +152,45 @@ type FetchResult struct {
 	Req          *FetchRequest
 	Err          error
 	DownloadSize int64
+
+	// StatusCode is the HTTP status of the server's response, or 0 if the
+	// request failed without a response.
+	StatusCode int
+
+	// Duration is the time taken by the fetch, including any retries.
+	Duration time.Duration
+
+	// Attempts is the number of times the fetch was attempted.
+	Attempts int
+
+	// NotModified is true if the server reported that the file had not
+	// changed since it was last downloaded.
+	NotModified bool
+}
+
+// Changed returns true if the fetch succeeded and wrote new data to the file.
+func (res *FetchResult) Changed() bool {
+	return res.Err == nil && !res.NotModified && res.DownloadSize > 0
+}
+
+func (res *FetchResult) String() string {
+	status := "ok"
+	switch {
+	case res.Err != nil:
+		status = "ERR " + res.Err.Error()
+	case res.NotModified:
+		status = "not modified"
+	}
+	return fmt.Sprintf("%s [%d] %d bytes in %s: %s", res.Req, res.StatusCode,
+		res.DownloadSize, res.Duration, status)
 }
 
 func fetchError(req *FetchRequest, err error) *FetchResult {
-	return &FetchResult{req, err, 0}
+	res := &FetchResult{Req: req, Err: err}
+	if httpErr, ok := err.(*HTTPError); ok {
+		res.StatusCode = httpErr.StatusCode
+	}
+	return res
 }
 
 // AddHeaders adds all headers in h to headers.
@@ -141,9 +217,10 @@ func HeadersWith(headers Headers, newHeader, newValue string) Headers {
 }
 
 // FileGetResponse makes a HTTP GET request to url and returns the response
-// object.
-func (h *Fetcher) FileGetResponse(url string, headers Headers) (*http.Response, error) {
-	request, err := http.NewRequest("GET", url, nil)
+// object. The request, including reads of the response body, is aborted if
+// ctx is cancelled.
+func (h *Fetcher) FileGetResponse(ctx context.Context, url string, headers Headers) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -153,6 +230,11 @@ func (h *Fetcher) FileGetResponse(url string, headers Headers) (*http.Response,
 		headers.AddHeaders(&request.Header)
 	}
 	resp, err := h.HTTPClient.Do(request)
+	if resp != nil {
+		recordRequestMetrics(url, resp.StatusCode)
+	} else {
+		recordRequestMetrics(url, 0)
+	}
 	if err != nil {
 		// resp may be non-nil if the server has redirect fail.
 		// See http://golang.org/src/pkg/net/http/client.go#L377
@@ -168,17 +250,55 @@ func (h *Fetcher) FileGetResponse(url string, headers Headers) (*http.Response,
 	return resp, nil
 }
 
-// FetchFile downloads a file as specified in req, writing a completion
-// FetchResult to complete.
-func (h *Fetcher) FetchFile(req *FetchRequest, complete chan<- *FetchResult) {
-	if !req.FullDownload {
+// FetchFile downloads a file as specified in req, retrying failures as
+// specified by h.Retry, and writes a completion FetchResult to complete. If
+// ctx is cancelled, the download is abandoned, and the result has ctx's
+// error.
+func (h *Fetcher) FetchFile(ctx context.Context, req *FetchRequest, complete chan<- *FetchResult) {
+	start := time.Now()
+	var res *FetchResult
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			res = fetchError(req, err)
+			break
+		}
+		res = h.fetchFileOnce(ctx, req)
+		res.Attempts = attempt
+		if attempt >= h.Retry.MaxAttempts || !h.Retry.Retryable(res) {
+			break
+		}
+		delay := h.Retry.Backoff(attempt, res)
+		log.Printf("%s: attempt %d failed (%s), retrying in %s\n", req, attempt, res.Err, delay)
+		metricRetries.Inc(urlHost(req.URL))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+	res.Duration = time.Since(start)
+	metricFetchDuration.Observe(res.Duration.Seconds(), urlHost(req.URL))
+	complete <- res
+}
+
+// fetchFileOnce makes a single attempt to download req, resuming the
+// download if possible.
+func (h *Fetcher) fetchFileOnce(ctx context.Context, req *FetchRequest) *FetchResult {
+	mode := downloadModeFull
+	fetch := h.NewFileDownload
+	if !req.FullDownload && req.Compression == compression.None {
 		finf, err := os.Stat(req.Filename)
 		if err == nil && finf != nil && finf.Size() > 0 {
-			h.ResumeFileDownload(req, complete)
-			return
+			mode, fetch = downloadModeResume, h.ResumeFileDownload
 		}
 	}
-	h.NewFileDownload(req, complete)
+
+	result := make(chan *FetchResult, 1)
+	fetch(ctx, req, result)
+	res := <-result
+	recordFetchMetrics(res, mode)
+	return res
 }
 
 func fileResumeHeaders(req *FetchRequest, file *os.File) (Headers, int64) {
@@ -199,62 +319,219 @@ func fileResumeHeaders(req *FetchRequest, file *os.File) (Headers, int64) {
 }
 
 // ResumeFileDownload downloads req and attempts to resume the download into
-// req.Filename. On completion, a FetchResult is written to the complete chan.
-func (h *Fetcher) ResumeFileDownload(req *FetchRequest, complete chan<- *FetchResult) {
-	var err error
-	handleError := func() {
-		complete <- fetchError(req, err)
-	}
+// req.Filename. If validators (ETag or Last-Modified) were saved by an
+// earlier download, the request is conditional, and a 304 (not modified)
+// response leaves the file alone. If the server ignores the Range request
+// (200), or rejects it (416) for any reason other than the file being
+// unchanged, or responds with a range that does not start at the end of the
+// local file, the file is downloaded in full. On completion, a FetchResult is
+// written to the complete chan.
+func (h *Fetcher) ResumeFileDownload(ctx context.Context, req *FetchRequest, complete chan<- *FetchResult) {
 	file, err := os.OpenFile(req.Filename,
 		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		handleError()
+		complete <- fetchError(req, err)
 		return
 	}
 	defer file.Close()
 
-	headers, _ := fileResumeHeaders(req, file)
-	resp, err := h.FileGetResponse(req.URL, headers)
-	if err == nil && resp.StatusCode != 206 {
-		resp.Body.Close()
-		err = fmt.Errorf("expected http 206 (partial content), got %d", resp.StatusCode)
-	}
-
-	var copied int64
+	headers, resumePoint := fileResumeHeaders(req, file)
+	headers = ReadFileMeta(req.Filename).conditionalHeaders(req.URL, headers)
+	resp, err := h.FileGetResponse(ctx, req.URL, headers)
 	if err != nil {
 		httpErr, _ := err.(*HTTPError)
 		if httpErr == nil || httpErr.StatusCode != http.StatusRequestedRangeNotSatisfiable {
-			handleError()
+			complete <- fetchError(req, err)
+			return
+		}
+		if remoteSize, ok := unsatisfiedRangeSize(httpErr.Response); ok && remoteSize == resumePoint {
+			saveFileMeta(req, httpErr.Response)
+			complete <- &FetchResult{Req: req, StatusCode: httpErr.StatusCode, NotModified: true}
+			return
+		}
+		log.Printf("%s: cannot resume at %d (remote file shrank?), downloading in full\n",
+			req, resumePoint)
+		h.NewFileDownload(ctx, req, complete)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		complete <- &FetchResult{Req: req, StatusCode: resp.StatusCode, NotModified: true}
+		return
+	case http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp); !ok || start != resumePoint {
+			log.Printf("%s: server sent range %#v for resume at %d, downloading in full\n",
+				req, resp.Header.Get("Content-Range"), resumePoint)
+			resp.Body.Close()
+			h.NewFileDownload(ctx, req, complete)
 			return
 		}
-		err = nil
+	case http.StatusOK:
+		// The server ignored the Range header, and is sending the whole file.
+		log.Printf("%s: server does not support resume, downloading in full\n", req)
+		complete <- writeFullDownload(req, resp)
+		return
+	default:
+		res := fetchError(req,
+			fmt.Errorf("expected http 206 (partial content), got %d", resp.StatusCode))
+		res.StatusCode = resp.StatusCode
+		complete <- res
+		return
+	}
+
+	// A short append leaves a prefix of the new data, and the next resume
+	// continues from there, so the data is appended directly:
+	copied, err := io.Copy(file, resp.Body)
+	if err == nil {
+		err = checkContentLength(resp, copied)
+	}
+	if err == nil {
+		saveFileMeta(req, resp)
+	}
+	complete <- &FetchResult{Req: req, Err: err, DownloadSize: copied, StatusCode: resp.StatusCode}
+}
+
+// contentRangeStart returns the first byte position in the Content-Range
+// header ("bytes <start>-<end>/<size>") of a 206 response.
+func contentRangeStart(resp *http.Response) (int64, bool) {
+	contentRange := resp.Header.Get("Content-Range")
+	const prefix = "bytes "
+	dash := strings.Index(contentRange, "-")
+	if !strings.HasPrefix(contentRange, prefix) || dash == -1 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(contentRange[len(prefix):dash], 10, 64)
+	return start, err == nil
+}
+
+// checkContentLength returns an error if the response declared a
+// Content-Length other than the received byte count.
+func checkContentLength(resp *http.Response, received int64) error {
+	if resp.ContentLength >= 0 && received != resp.ContentLength {
+		return fmt.Errorf("%s: received %d bytes, expected Content-Length %d",
+			resp.Request.URL, received, resp.ContentLength)
+	}
+	return nil
+}
+
+// unsatisfiedRangeSize returns the size of the remote file as reported in the
+// Content-Range header ("bytes */<size>") of a 416 response.
+func unsatisfiedRangeSize(resp *http.Response) (int64, bool) {
+	contentRange := resp.Header.Get("Content-Range")
+	const prefix = "bytes */"
+	if !strings.HasPrefix(contentRange, prefix) {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(contentRange, prefix), 10, 64)
+	return size, err == nil
+}
+
+// saveFileMeta saves the validators in resp for req.Filename, so that later
+// requests may be conditional.
+func saveFileMeta(req *FetchRequest, resp *http.Response) {
+	var err error
+	if meta := responseFileMeta(req.URL, resp); meta != nil {
+		err = WriteFileMeta(req.Filename, meta)
 	} else {
-		defer resp.Body.Close()
-		copied, err = io.Copy(file, resp.Body)
+		err = RemoveFileMeta(req.Filename)
+	}
+	if err != nil {
+		log.Printf("%s: error saving fetch metadata: %s\n", req, err)
 	}
-	complete <- &FetchResult{req, err, copied}
 }
 
 // NewFileDownload downloads a file as specified in req, writing a fetch result
 // to the complete chan when done. File downloads are not resumed, so any
-// existing file will be overwritten.
-func (h *Fetcher) NewFileDownload(req *FetchRequest, complete chan<- *FetchResult) {
-	resp, err := h.FileGetResponse(req.URL, req.RequestHeaders)
+// existing file will be replaced. The server may gzip the response; if
+// req.Compression is set, the file itself is decompressed instead.
+func (h *Fetcher) NewFileDownload(ctx context.Context, req *FetchRequest, complete chan<- *FetchResult) {
+	resp, err := h.FileGetResponse(ctx, req.URL, fullDownloadHeaders(req))
 	if err != nil {
 		complete <- fetchError(req, err)
 		return
 	}
 	defer resp.Body.Close()
+	complete <- writeFullDownload(req, resp)
+}
 
-	file, err := os.Create(req.Filename)
+// writeFullDownload saves the body of resp, which must be the complete file,
+// to req.Filename. The body is written to a temporary file in the same
+// directory, which replaces req.Filename only if the complete body (as
+// given by the Content-Length) was received, so an interrupted download
+// leaves any existing file untouched.
+func writeFullDownload(req *FetchRequest, resp *http.Response) *FetchResult {
+	result := func(err error, size int64) *FetchResult {
+		return &FetchResult{Req: req, Err: err, DownloadSize: size, StatusCode: resp.StatusCode}
+	}
+
+	received := &countingReader{r: resp.Body}
+	format := req.Compression
+	if format == compression.None {
+		format = compression.ContentEncodingFormat(resp.Header.Get("Content-Encoding"))
+	}
+	body, err := compression.NewReader(format, received)
 	if err != nil {
-		complete <- fetchError(req, err)
-		return
+		return result(err, 0)
 	}
-	defer file.Close()
+	defer body.Close()
 
-	copied, err := io.Copy(file, resp.Body)
-	complete <- &FetchResult{req, err, copied}
+	dir, base := filepath.Split(req.Filename)
+	file, err := ioutil.TempFile(dir, "."+base+".*.tmp")
+	if err != nil {
+		return result(err, 0)
+	}
+	tmpName := file.Name()
+	copied, err := io.Copy(file, body)
+	if err == nil {
+		err = checkContentLength(resp, received.n)
+	}
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Validators from an earlier download no longer apply to the new file:
+	if err == nil {
+		err = RemoveFileMeta(req.Filename)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, req.Filename)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return result(err, copied)
+	}
+	saveFileMeta(req, resp)
+	return result(nil, copied)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// fullDownloadHeaders returns the request headers for a full download of
+// req, asking for a gzipped response unless the remote file is already
+// compressed (or req sets its own Accept-Encoding).
+func fullDownloadHeaders(req *FetchRequest) Headers {
+	if _, ok := req.RequestHeaders["Accept-Encoding"]; ok {
+		return req.RequestHeaders
+	}
+	encoding := "gzip"
+	if req.Compression != compression.None {
+		encoding = "identity"
+	}
+	return HeadersWith(req.RequestHeaders, "Accept-Encoding", encoding)
 }
 
 func groupFetchRequestsByHost(requests []*FetchRequest) map[string][]*FetchRequest {
@@ -267,7 +544,10 @@ func groupFetchRequestsByHost(requests []*FetchRequest) map[string][]*FetchReque
 }
 
 // QueueFetch enqueues the given download requests for asynchronous download.
+// Results are reported only to OnResult; use Fetch to receive them.
 func (h *Fetcher) QueueFetch(req []*FetchRequest) {
+	h.hostMutex.Lock()
+	defer h.hostMutex.Unlock()
 	for host, reqs := range groupFetchRequestsByHost(req) {
 		hostQueue := h.hostQueue(host)
 		h.enqueueWaitGroup.Add(1)
@@ -275,15 +555,87 @@ func (h *Fetcher) QueueFetch(req []*FetchRequest) {
 	}
 }
 
+// Fetch enqueues the given download requests for asynchronous download, and
+// returns a channel that receives the result of each request (in order of
+// completion), and is closed when all requests are complete. The channel is
+// buffered, so the caller need not read results as they arrive. Requests
+// must not be reused across calls to Fetch.
+//
+// If ctx is cancelled, downloads in progress are abandoned, and requests
+// still in the queue fail immediately with ctx's error.
+func (h *Fetcher) Fetch(ctx context.Context, reqs []*FetchRequest) <-chan *FetchResult {
+	batch := newFetchBatch(ctx, len(reqs))
+	for _, req := range reqs {
+		req.batch = batch
+	}
+	h.QueueFetch(reqs)
+	return batch.results
+}
+
+// A fetchBatch collects the results of the requests passed to a single
+// Fetch call.
+type fetchBatch struct {
+	ctx     context.Context
+	mutex   sync.Mutex
+	pending int
+	results chan *FetchResult
+}
+
+func newFetchBatch(ctx context.Context, size int) *fetchBatch {
+	batch := &fetchBatch{
+		ctx:     ctx,
+		pending: size,
+		results: make(chan *FetchResult, size),
+	}
+	if size == 0 {
+		close(batch.results)
+	}
+	return batch
+}
+
+func (b *fetchBatch) add(res *FetchResult) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.results <- res
+	b.pending--
+	if b.pending == 0 {
+		close(b.results)
+	}
+}
+
+// context returns the context for req: its batch's context, or the
+// background context for requests queued with QueueFetch.
+func (req *FetchRequest) context() context.Context {
+	if req.batch == nil {
+		return context.Background()
+	}
+	return req.batch.ctx
+}
+
+// reportResult sends res to the batch of the request it is for, if any.
+func reportResult(req *FetchRequest, res *FetchResult) {
+	if req.batch == nil {
+		return
+	}
+	if res.Req != req {
+		copy := *res
+		copy.Req = req
+		res = &copy
+	}
+	req.batch.add(res)
+}
+
 // Shutdown gracefully shuts down the fetcher, cleaning up all
 // background goroutines, and waiting for all outstanding downloads to
 // end.
 func (h *Fetcher) Shutdown() {
 	h.enqueueWaitGroup.Wait()
+	h.hostMutex.Lock()
 	for host, queue := range h.hostQueues {
 		close(queue)
 		delete(h.hostQueues, host)
 	}
+	h.hostMutex.Unlock()
 	h.hostWaitGroup.Wait()
 }
 
@@ -294,6 +646,8 @@ func (h *Fetcher) enqueueRequests(queue chan<- *FetchRequest, reqs []*FetchReque
 	h.enqueueWaitGroup.Done()
 }
 
+// hostQueue returns the queue for host, starting its service goroutine if
+// necessary. The caller must hold hostMutex.
 func (h *Fetcher) hostQueue(host string) chan<- *FetchRequest {
 	queue := h.hostQueues[host]
 	if queue == nil {
@@ -317,7 +671,7 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 	for i := 0; i < nSlaves; i++ {
 		go func() {
 			for req := range slaveQueue {
-				h.FetchFile(req, slaveResult)
+				h.FetchFile(req.context(), req, slaveResult)
 			}
 			slaveWaitGroup.Done()
 		}()
@@ -330,8 +684,10 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 		close(slaveResult)
 	}()
 
+	breaker := newHostBreaker(host, h.BreakerThreshold, h.BreakerCooldown)
 	queue := []*FetchRequest{}
-	inProgress := map[string]bool{}
+	// Requests in progress, and any duplicates waiting on their results:
+	inProgress := map[string][]*FetchRequest{}
 	reqKey := func(req *FetchRequest) string {
 		return req.URL + " | " + req.Filename
 	}
@@ -339,21 +695,62 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 	queueRequest := func(req *FetchRequest) {
 		// Suppress duplicate fetch requests:
 		key := reqKey(req)
-		if inProgress[key] {
+		if waiting, ok := inProgress[key]; ok {
 			log.Printf("%s: ignoring duplicate download %s\n", host, req.URL)
+			inProgress[key] = append(waiting, req)
 			return
 		}
-		inProgress[key] = true
+		inProgress[key] = []*FetchRequest{req}
 		queue = append(queue, req)
 	}
 
 	applyResult := func(res *FetchResult) {
-		delete(inProgress, reqKey(res.Req))
+		key := reqKey(res.Req)
+		waiting := inProgress[key]
+		delete(inProgress, key)
 		if res.Err != nil {
 			log.Printf("ERR %s (%s)\n", res.Req, res.Err)
 		} else if res.DownloadSize > 0 {
 			log.Printf("ok %s [%d]\n", res.Req, res.DownloadSize)
 		}
+		if h.OnResult != nil {
+			h.OnResult(res)
+		}
+		for _, req := range waiting {
+			reportResult(req, res)
+		}
+	}
+
+	recordBreakerResult := func(res *FetchResult) {
+		// A cancelled fetch says nothing about the host:
+		if isCancelled(res.Err) {
+			return
+		}
+		wasTripped := breaker.tripped()
+		breaker.record(h.Retry.Retryable(res), time.Now())
+		if breaker.tripped() {
+			if !wasTripped {
+				log.Printf("%s: suspending downloads for %s after %d failures\n",
+					host, h.BreakerCooldown, breaker.failures)
+			}
+			metricHostSuspended.Set(1, host)
+		} else {
+			metricHostSuspended.Set(0, host)
+		}
+	}
+
+	// failSuspended fails all queued requests immediately if the host is
+	// suspended.
+	failSuspended := func() {
+		err := breaker.suspended(time.Now())
+		if err == nil || len(queue) == 0 {
+			return
+		}
+		log.Printf("%s: failing %d queued downloads: %s\n", host, len(queue), err)
+		for _, req := range queue {
+			applyResult(fetchError(req, err))
+		}
+		queue = nil
 	}
 
 	firstItem := func() *FetchRequest {
@@ -363,7 +760,7 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 		return queue[0]
 	}
 	slaveQueueOrNil := func() chan<- *FetchRequest {
-		if len(queue) == 0 {
+		if len(queue) == 0 || !breaker.canDispatch(time.Now()) {
 			return nil
 		}
 		return slaveQueue
@@ -376,6 +773,7 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 		select {
 		case slaveQueueOrNil() <- firstItem():
 			queue = queue[1:]
+			breaker.dispatched()
 		case newRequest := <-incoming:
 			if newRequest == nil {
 				log.Printf("%s: Download queue shutting down\n", host)
@@ -384,13 +782,16 @@ func (h *Fetcher) monitorHostQueue(host string, incoming <-chan *FetchRequest) {
 			}
 			queueRequest(newRequest)
 		case result := <-slaveResult:
+			recordBreakerResult(result)
 			applyResult(result)
 		}
+		failSuspended()
 	}
 
 	// Exiting, clean up:
 	close(slaveQueue)
 	for res := range slaveResult {
+		recordBreakerResult(res)
 		applyResult(res)
 	}
 	h.hostWaitGroup.Done()
@@ -0,0 +1,316 @@
+package httpfetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/crawl/go-sequell/compression"
+)
+
+const testETag = `"v2"`
+
+// testServer serves content with an ETag, honoring If-None-Match and byte
+// ranges unless ignoreRange is set.
+func testServer(content string, ignoreRange bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", testETag)
+		if r.Header.Get("If-None-Match") == testETag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rangeHeader := r.Header.Get("Range")
+		if rangeHeader == "" || ignoreRange {
+			fmt.Fprint(w, content)
+			return
+		}
+		start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if start >= len(content) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, content[start:])
+	}))
+}
+
+func fetch(t *testing.T, url, filename string) *FetchResult {
+	complete := make(chan *FetchResult, 1)
+	New().FetchFile(context.Background(), &FetchRequest{URL: url, Filename: filename}, complete)
+	res := <-complete
+	if res.Err != nil {
+		t.Fatalf("FetchFile(%s) failed: %s", url, res.Err)
+	}
+	return res
+}
+
+func TestResumeFileDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		name        string
+		local       string
+		remote      string
+		ignoreRange bool
+		writeMeta   bool
+		expected    string
+		notModified bool
+	}{
+		{name: "resume", local: "abc\n", remote: "abc\ndef\n", expected: "abc\ndef\n"},
+		{name: "not-modified", local: "abc\n", remote: "abc\ndef\n", writeMeta: true, expected: "abc\n", notModified: true},
+		{name: "range-ignored", local: "xyz\n", remote: "abc\ndef\n", ignoreRange: true, expected: "abc\ndef\n"},
+		{name: "unchanged-size", local: "abc\n", remote: "abc\n", expected: "abc\n", notModified: true},
+		{name: "shrunk", local: "abc\ndef\nghi\n", remote: "abc\n", expected: "abc\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := testServer(test.remote, test.ignoreRange)
+			defer server.Close()
+
+			filename := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(filename, []byte(test.local), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.writeMeta {
+				if err := WriteFileMeta(filename, &FileMeta{URL: server.URL, ETag: testETag}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			res := fetch(t, server.URL, filename)
+			if res.NotModified != test.notModified {
+				t.Errorf("NotModified = %v, expected %v", res.NotModified, test.notModified)
+			}
+			if text, _ := ioutil.ReadFile(filename); string(text) != test.expected {
+				t.Errorf("file contents = %#v, expected %#v", string(text), test.expected)
+			}
+			if meta := ReadFileMeta(filename); meta == nil || meta.ETag != testETag || meta.URL != server.URL {
+				t.Errorf("ReadFileMeta = %#v, expected ETag %s for %s", meta, testETag, server.URL)
+			}
+		})
+	}
+}
+
+func gzipText(text string) []byte {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(text))
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestNewFileDownloadCompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const content = "abc\ndef\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logfile":
+			if r.Header.Get("Accept-Encoding") != "gzip" {
+				fmt.Fprint(w, content)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipText(content))
+		case "/logfile.gz":
+			// Servers often label static .gz files with a Content-Encoding.
+			w.Header().Set("Content-Encoding", "x-gzip")
+			w.Write(gzipText(content))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	for _, req := range []*FetchRequest{
+		{URL: server.URL + "/logfile", Filename: filepath.Join(dir, "encoded")},
+		{URL: server.URL + "/logfile.gz", Filename: filepath.Join(dir, "compressed"), Compression: compression.Gzip},
+	} {
+		complete := make(chan *FetchResult, 1)
+		New().FetchFile(context.Background(), req, complete)
+		if res := <-complete; res.Err != nil {
+			t.Errorf("FetchFile(%s) failed: %s", req, res.Err)
+			continue
+		}
+		if text, _ := ioutil.ReadFile(req.Filename); string(text) != content {
+			t.Errorf("FetchFile(%s) wrote %#v, expected %#v", req, string(text), content)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := testServer("abc\n", false)
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.Retry = RetryPolicy{}
+	defer fetcher.Shutdown()
+	reqs := []*FetchRequest{
+		{URL: server.URL + "/a", Filename: filepath.Join(dir, "a")},
+		{URL: server.URL + "/a", Filename: filepath.Join(dir, "a")},
+		{URL: server.URL + "/b", Filename: filepath.Join(dir, "b")},
+		{URL: "http://127.0.0.1:1/c", Filename: filepath.Join(dir, "c")},
+	}
+	seen := map[*FetchRequest]*FetchResult{}
+	for res := range fetcher.Fetch(context.Background(), reqs) {
+		seen[res.Req] = res
+	}
+	if len(seen) != len(reqs) {
+		t.Fatalf("Fetch returned %d results, expected %d", len(seen), len(reqs))
+	}
+	for _, req := range reqs[:3] {
+		res := seen[req]
+		if res.Err != nil || res.StatusCode != http.StatusOK || !res.Changed() || res.DownloadSize != 4 {
+			t.Errorf("Fetch(%s) = %s, expected 4 bytes with status 200", req, res)
+		}
+	}
+	if res := seen[reqs[3]]; res.Err == nil || res.StatusCode != 0 || res.Changed() {
+		t.Errorf("Fetch(%s) = %s, expected connection error", reqs[3], res)
+	}
+
+	if _, ok := <-fetcher.Fetch(context.Background(), nil); ok {
+		t.Errorf("Fetch(nil) returned a result, expected closed channel")
+	}
+}
+
+func TestFullDownloadAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/truncated":
+			// The connection drops before the full body is sent:
+			w.Header().Set("Content-Length", "100")
+			fmt.Fprint(w, "abc\n")
+		case "/bad-range":
+			// The server sends a range other than the one requested:
+			w.Header().Set("Content-Range", "bytes 0-7/8")
+			w.WriteHeader(http.StatusPartialContent)
+			fmt.Fprint(w, "abc\ndef\n")
+		}
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(dir, "truncated")
+	if err := ioutil.WriteFile(filename, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	complete := make(chan *FetchResult, 1)
+	fetcher := New()
+	fetcher.Retry = RetryPolicy{}
+	fetcher.FetchFile(context.Background(), &FetchRequest{URL: server.URL + "/truncated", Filename: filename, FullDownload: true}, complete)
+	if res := <-complete; res.Err == nil {
+		t.Errorf("Truncated download succeeded, expected error")
+	}
+	if text, _ := ioutil.ReadFile(filename); string(text) != "old\n" {
+		t.Errorf("Truncated download changed file to %#v", string(text))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Truncated download left %d files in %s, expected 1", len(files), dir)
+	}
+
+	filename = filepath.Join(dir, "bad-range")
+	if err := ioutil.WriteFile(filename, []byte("abc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fetch(t, server.URL+"/bad-range", filename)
+	if text, _ := ioutil.ReadFile(filename); string(text) != "abc\ndef\n" {
+		t.Errorf("Resume with bad range wrote %#v, expected full download", string(text))
+	}
+}
+
+func TestFetchCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := make(chan bool, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		// Hang until the client gives up:
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	defer fetcher.Shutdown()
+	ctx, cancel := context.WithCancel(context.Background())
+	results := fetcher.Fetch(ctx, []*FetchRequest{
+		{URL: server.URL + "/hang", Filename: filepath.Join(dir, "hang")},
+	})
+	<-started
+	cancel()
+	res := <-results
+	if !isCancelled(res.Err) || res.Attempts != 1 {
+		t.Errorf("Fetch after cancel = %s (attempts: %d), expected a single cancelled attempt", res, res.Attempts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "hang")); !os.IsNotExist(err) {
+		t.Errorf("Cancelled fetch created the target file")
+	}
+}
+
+func TestFetchConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := testServer("abc\n", false)
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.Retry = RetryPolicy{}
+	defer fetcher.Shutdown()
+	const nfetches = 8
+	done := make(chan int, nfetches)
+	for i := 0; i < nfetches; i++ {
+		go func(i int) {
+			name := "f" + strconv.Itoa(i)
+			n := 0
+			for res := range fetcher.Fetch(context.Background(), []*FetchRequest{
+				{URL: server.URL + "/" + name, Filename: filepath.Join(dir, name)},
+			}) {
+				if res.Err == nil {
+					n++
+				}
+			}
+			done <- n
+		}(i)
+	}
+	for i := 0; i < nfetches; i++ {
+		if n := <-done; n != 1 {
+			t.Errorf("concurrent Fetch completed %d requests, expected 1", n)
+		}
+	}
+}
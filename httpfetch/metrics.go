@@ -0,0 +1,59 @@
+package httpfetch
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/crawl/go-sequell/metrics"
+)
+
+var (
+	metricDownloadedBytes = metrics.Default.NewCounter(
+		"sequell_httpfetch_downloaded_bytes_total",
+		"Bytes downloaded from remote servers.", "host")
+	metricRequests = metrics.Default.NewCounter(
+		"sequell_httpfetch_requests_total",
+		"HTTP requests made, by HTTP status code (or \"error\" if the request failed without a response).",
+		"host", "status")
+	metricDownloads = metrics.Default.NewCounter(
+		"sequell_httpfetch_downloads_total",
+		"File downloads, by mode: \"resume\" for Range requests appending to existing files, \"full\" for complete downloads.",
+		"host", "mode")
+	metricFetchDuration = metrics.Default.NewSummary(
+		"sequell_httpfetch_fetch_duration_seconds",
+		"Time taken to fetch files, including failed fetches and retries.", "host")
+	metricRetries = metrics.Default.NewCounter(
+		"sequell_httpfetch_retries_total",
+		"Failed fetches that were retried.", "host")
+	metricHostSuspended = metrics.Default.NewGauge(
+		"sequell_httpfetch_host_suspended",
+		"1 if the host's circuit breaker has tripped after repeated failures, else 0.", "host")
+)
+
+// Download modes for metrics.
+const (
+	downloadModeResume = "resume"
+	downloadModeFull   = "full"
+)
+
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func recordRequestMetrics(rawURL string, statusCode int) {
+	status := "error"
+	if statusCode != 0 {
+		status = strconv.Itoa(statusCode)
+	}
+	metricRequests.Inc(urlHost(rawURL), status)
+}
+
+func recordFetchMetrics(res *FetchResult, mode string) {
+	host := urlHost(res.Req.URL)
+	metricDownloads.Inc(host, mode)
+	metricDownloadedBytes.Add(float64(res.DownloadSize), host)
+}
@@ -0,0 +1,117 @@
+package httpfetch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A RetryPolicy specifies how failed fetches are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts to fetch a file,
+	// including the first. Fetches are not retried if MaxAttempts <= 1.
+	MaxAttempts int
+
+	// RetryStatuses are the HTTP status codes that are retried. Network
+	// errors (timeouts, refused connections, dropped connections) are
+	// always retried.
+	RetryStatuses []int
+
+	// InitialBackoff is the delay before the first retry; each later retry
+	// doubles the delay, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Jitter is the fraction of the delay by which retries are randomly
+	// offset.
+	Jitter float64
+}
+
+// DefaultRetryPolicy retries network errors and server errors twice.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	RetryStatuses: []int{
+		http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.2,
+}
+
+// Retryable returns true if res is a failure that may succeed if retried:
+// a network error or a response with one of the RetryStatuses.
+func (p RetryPolicy) Retryable(res *FetchResult) bool {
+	if res.Err == nil || isCancelled(res.Err) {
+		return false
+	}
+	if res.StatusCode == 0 {
+		return isNetworkError(res.Err)
+	}
+	for _, status := range p.RetryStatuses {
+		if res.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns the delay before retrying after the given number of failed
+// attempts. If the server's response to res had a Retry-After delay, that
+// delay is used instead, up to MaxBackoff.
+func (p RetryPolicy) Backoff(failures int, res *FetchResult) time.Duration {
+	if delay, ok := retryAfter(res); ok {
+		if delay > p.MaxBackoff {
+			delay = p.MaxBackoff
+		}
+		return delay
+	}
+	delay := p.InitialBackoff
+	for i := 1; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if spread := int64(float64(delay) * p.Jitter); spread > 0 {
+		delay += time.Duration(rand.Int63n(2*spread+1) - spread)
+	}
+	return delay
+}
+
+// retryAfter returns the delay in seconds from the Retry-After header of the
+// error response in res, if any.
+func retryAfter(res *FetchResult) (time.Duration, bool) {
+	httpErr, ok := res.Err.(*HTTPError)
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(httpErr.Response.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func isNetworkError(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// isCancelled returns true if err is the result of a cancelled or expired
+// context.
+func isCancelled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
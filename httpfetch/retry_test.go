@@ -0,0 +1,145 @@
+package httpfetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	policy := DefaultRetryPolicy
+	tests := []struct {
+		res       *FetchResult
+		retryable bool
+	}{
+		{&FetchResult{}, false},
+		{&FetchResult{Err: errors.New("disk full")}, false},
+		{&FetchResult{Err: errors.New("503"), StatusCode: 503}, true},
+		{&FetchResult{Err: errors.New("404"), StatusCode: 404}, false},
+		{&FetchResult{Err: &HostSuspendedError{Host: "x"}}, false},
+	}
+	for _, test := range tests {
+		if retryable := policy.Retryable(test.res); retryable != test.retryable {
+			t.Errorf("Retryable(%#v) = %v, expected %v", test.res, retryable, test.retryable)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for failures, expected := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if failures == 0 {
+			continue
+		}
+		if delay := policy.Backoff(failures, &FetchResult{}); delay != expected {
+			t.Errorf("Backoff(%d) = %s, expected %s", failures, delay, expected)
+		}
+	}
+}
+
+func TestFetchRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "abc\n")
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.Retry.InitialBackoff = time.Millisecond
+	fetcher.Retry.MaxBackoff = time.Millisecond
+	complete := make(chan *FetchResult, 1)
+	fetcher.FetchFile(context.Background(), &FetchRequest{URL: server.URL, Filename: filepath.Join(dir, "log")}, complete)
+	if res := <-complete; res.Err != nil || res.Attempts != 3 {
+		t.Errorf("FetchFile = %s after %d attempts, expected success after 3", res, res.Attempts)
+	}
+}
+
+func TestHostBreaker(t *testing.T) {
+	now := time.Now()
+	b := newHostBreaker("host", 2, time.Minute)
+	b.record(true, now)
+	if b.suspended(now) != nil || !b.canDispatch(now) {
+		t.Errorf("breaker suspended after one failure")
+	}
+	b.record(true, now)
+	if b.suspended(now) == nil || b.canDispatch(now) {
+		t.Errorf("breaker not suspended after two failures")
+	}
+
+	// After the cooldown, a single probe is allowed:
+	later := now.Add(time.Minute)
+	if b.suspended(later) != nil || !b.canDispatch(later) {
+		t.Errorf("breaker did not allow probe after cooldown")
+	}
+	b.dispatched()
+	if b.canDispatch(later) {
+		t.Errorf("breaker allowed a second request while probing")
+	}
+	b.record(true, later)
+	if b.suspended(later) == nil {
+		t.Errorf("breaker not suspended after failed probe")
+	}
+
+	muchLater := later.Add(time.Minute)
+	b.dispatched()
+	b.record(false, muchLater)
+	if b.tripped() || !b.canDispatch(muchLater) {
+		t.Errorf("breaker not reset after successful probe")
+	}
+}
+
+func TestFetchSuspendsFailingHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpfetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	fetcher := New()
+	fetcher.Retry = RetryPolicy{RetryStatuses: []int{http.StatusBadGateway}}
+	fetcher.MaxConcurrentRequestsPerHost = 1
+	fetcher.BreakerThreshold = 2
+	defer fetcher.Shutdown()
+
+	reqs := []*FetchRequest{}
+	for i := 0; i < 5; i++ {
+		reqs = append(reqs, &FetchRequest{
+			URL:      fmt.Sprintf("%s/%d", server.URL, i),
+			Filename: filepath.Join(dir, fmt.Sprint(i)),
+		})
+	}
+	suspended := 0
+	for res := range fetcher.Fetch(context.Background(), reqs) {
+		if _, ok := res.Err.(*HostSuspendedError); ok {
+			suspended++
+		}
+	}
+	if requests != 2 || suspended != 3 {
+		t.Errorf("%d requests made and %d suspended, expected 2 and 3", requests, suspended)
+	}
+}
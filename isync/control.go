@@ -0,0 +1,261 @@
+package isync
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/metrics"
+)
+
+// unixSocketPrefix marks a control address as a Unix socket path.
+const unixSocketPrefix = "unix:"
+
+// controlListenAddr returns the network and address the control server
+// listens on for the control address addr. A TCP address without a host
+// (such as ":8080" or "8080") listens on the loopback interface only. Other
+// hosts are accepted only if the control server requires a token.
+func controlListenAddr(addr, token string) (network, listenAddr string, err error) {
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixSocketPrefix), nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Contains(addr, ":") {
+			return "", "", err
+		}
+		host, port = "", addr
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if token == "" && !isLoopbackHost(host) {
+		return "", "", fmt.Errorf("control server on %s would be reachable from other hosts: listen on localhost or set a control token", addr)
+	}
+	return "tcp", net.JoinHostPort(host, port), nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startControlServer starts the HTTP control server listening on
+// l.ControlAddr, if set. TCP control servers listen on localhost unless
+// another host is named, which requires l.ControlToken; Unix sockets are
+// accessible only to isync's user. If l.ControlToken is set, every request
+// must carry it as "Authorization: Bearer <token>". The control server
+// accepts:
+//
+//	POST /fetch[?filter=X&filter=Y]  fetch all logs, or logs matching any filter
+//	POST /reload                     reload sources.yml and crawl-data.yml
+//	POST /pause                      stop loading changed logs
+//	POST /resume                     resume loading logs
+//	POST /exit                       shut down isync
+//	GET  /status                     report per-file offsets, fetches and errors
+//	GET  /metrics                    fetch and load metrics in Prometheus format
+func (l *Sync) startControlServer() error {
+	if l.ControlAddr == "" {
+		return nil
+	}
+	network, addr, err := controlListenAddr(l.ControlAddr, l.ControlToken)
+	if err != nil {
+		return err
+	}
+	var listener net.Listener
+	if network == "unix" {
+		listener, err = listenPrivateUnix(addr)
+	} else {
+		listener, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fetch", l.postHandler(l.handleFetch))
+	mux.HandleFunc("/reload", l.postHandler(l.handleReload))
+	mux.HandleFunc("/pause", l.postHandler(l.handlePause))
+	mux.HandleFunc("/resume", l.postHandler(l.handleResume))
+	mux.HandleFunc("/exit", l.postHandler(l.handleExit))
+	mux.HandleFunc("/status", l.handleStatus)
+	mux.Handle("/metrics", metrics.Default.Handler())
+	l.controlServer = &http.Server{Handler: l.authHandler(mux)}
+
+	log.Printf("Control server listening on %s %s\n", network, addr)
+	l.masterWaitGroup.Add(1)
+	go func() {
+		if err := l.controlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println("control server error:", err)
+		}
+		if network == "unix" {
+			os.Remove(addr)
+		}
+		log.Println("control server exiting")
+		l.masterWaitGroup.Done()
+	}()
+	return nil
+}
+
+// listenPrivateUnix listens on a Unix socket at path that only the current
+// user can connect to. The socket is created and chmodded inside a private
+// (0700) directory next to path and then renamed into place, so it is never
+// reachable by other users, whatever the umask.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".isync-control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "control.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is moved to path, so don't unlink tmpPath on close:
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	// Replace any stale socket from an earlier run:
+	if err = os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (l *Sync) stopControlServer() {
+	if l.controlServer != nil {
+		l.controlServer.Close()
+	}
+}
+
+// authHandler rejects requests that do not carry l.ControlToken, if set.
+func (l *Sync) authHandler(handler http.Handler) http.Handler {
+	if l.ControlToken == "" {
+		return handler
+	}
+	want := []byte("Bearer " + l.ControlToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized,
+				map[string]string{"error": "missing or bad control token"})
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (l *Sync) postHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed,
+				map[string]string{"error": "use POST"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (l *Sync) handleFetch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	filters := r.Form["filter"]
+	if !l.requestFetch(filters) {
+		writeJSON(w, http.StatusTooManyRequests,
+			map[string]string{"error": "a fetch is already pending"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted,
+		map[string]interface{}{"fetch": "queued", "filters": filters})
+}
+
+func (l *Sync) handleReload(w http.ResponseWriter, r *http.Request) {
+	l.requestReload()
+	writeJSON(w, http.StatusAccepted, map[string]string{"reload": "queued"})
+}
+
+func (l *Sync) handlePause(w http.ResponseWriter, r *http.Request) {
+	l.pauseLoading()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (l *Sync) handleResume(w http.ResponseWriter, r *http.Request) {
+	l.resumeLoading()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func (l *Sync) handleExit(w http.ResponseWriter, r *http.Request) {
+	select {
+	case l.exitRequests <- true:
+	default:
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"exit": "queued"})
+}
+
+func (l *Sync) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed,
+			map[string]string{"error": "use GET"})
+		return
+	}
+	offsets, err := l.fileOffsets()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError,
+			map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, l.status.snapshot(offsets, loader.NormalizeValue))
+}
+
+// fileOffsets returns the last loaded offset of every file in the db.
+func (l *Sync) fileOffsets() (map[string]int64, error) {
+	rows, err := l.DB.Query(`select file, file_offset from l_file`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	offsets := map[string]int64{}
+	for rows.Next() {
+		var file string
+		var offset sql.NullInt64
+		if err = rows.Scan(&file, &offset); err != nil {
+			return nil, err
+		}
+		if offset.Valid {
+			offsets[file] = offset.Int64
+		}
+	}
+	return offsets, rows.Err()
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(value); err != nil {
+		log.Println("control server: error writing response:", err)
+	}
+}
@@ -0,0 +1,199 @@
+package isync
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func newTestSync() *Sync {
+	return &Sync{
+		status:         newSyncStatus(),
+		fetchRequests:  make(chan *fetchRequest, 1),
+		resumeRequests: make(chan bool, 1),
+		exitRequests:   make(chan bool, 1),
+		reloadRequests: make(chan bool, 1),
+		fetchingFiles:  map[string]map[int]context.CancelFunc{},
+		fetchedFiles:   map[string]bool{},
+		fetchedWake:    make(chan bool, 1),
+		scheduleWake:   make(chan bool, 1),
+	}
+}
+
+func TestControlFetch(t *testing.T) {
+	l := newTestSync()
+	handler := l.postHandler(l.handleFetch)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/fetch", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /fetch: status %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/fetch?filter=cao&filter=cue", nil))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("POST /fetch: status %d, expected %d", w.Code, http.StatusAccepted)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/fetch", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("POST /fetch with pending fetch: status %d, expected %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	req := <-l.fetchRequests
+	if len(req.filters) != 2 || req.filters[0] != "cao" || req.filters[1] != "cue" {
+		t.Errorf("fetch request filters = %#v, expected [cao cue]", req.filters)
+	}
+	if l.status.lastFetchRequest == nil {
+		t.Errorf("fetch request time not recorded")
+	}
+}
+
+func TestControlPauseResume(t *testing.T) {
+	l := newTestSync()
+	w := httptest.NewRecorder()
+	l.postHandler(l.handlePause)(w, httptest.NewRequest("POST", "/pause", nil))
+	if w.Code != http.StatusOK || !l.status.isPaused() {
+		t.Errorf("POST /pause: status %d, paused=%v", w.Code, l.status.isPaused())
+	}
+
+	w = httptest.NewRecorder()
+	l.postHandler(l.handleResume)(w, httptest.NewRequest("POST", "/resume", nil))
+	if w.Code != http.StatusOK || l.status.isPaused() {
+		t.Errorf("POST /resume: status %d, paused=%v", w.Code, l.status.isPaused())
+	}
+	select {
+	case <-l.resumeRequests:
+	default:
+		t.Errorf("POST /resume did not signal the log loader")
+	}
+}
+
+func TestHandleSignal(t *testing.T) {
+	l := newTestSync()
+
+	l.handleSignal(syscall.SIGUSR1)
+	if len(l.fetchRequests) != 1 {
+		t.Errorf("SIGUSR1 did not request a fetch")
+	}
+	l.handleSignal(syscall.SIGUSR1)
+	if len(l.fetchRequests) != 1 {
+		t.Errorf("SIGUSR1 queued a second fetch while one was pending")
+	}
+
+	l.handleSignal(syscall.SIGHUP)
+	if len(l.reloadRequests) != 1 {
+		t.Errorf("SIGHUP did not request a reload")
+	}
+	// A second request while one is pending must not block:
+	l.handleSignal(syscall.SIGHUP)
+	l.postHandler(l.handleReload)(httptest.NewRecorder(), httptest.NewRequest("POST", "/reload", nil))
+	if len(l.reloadRequests) != 1 {
+		t.Errorf("pending reload requests = %d, expected 1", len(l.reloadRequests))
+	}
+}
+
+func TestControlListenAddr(t *testing.T) {
+	tests := []struct {
+		addr, token     string
+		network, laddr  string
+		expectListenErr bool
+	}{
+		{":8080", "", "tcp", "127.0.0.1:8080", false},
+		{"8080", "", "tcp", "127.0.0.1:8080", false},
+		{"localhost:8080", "", "tcp", "localhost:8080", false},
+		{"[::1]:8080", "", "tcp", "[::1]:8080", false},
+		{"0.0.0.0:8080", "", "", "", true},
+		{"0.0.0.0:8080", "secret", "tcp", "0.0.0.0:8080", false},
+		{"unix:/tmp/isync.sock", "", "unix", "/tmp/isync.sock", false},
+	}
+	for _, test := range tests {
+		network, laddr, err := controlListenAddr(test.addr, test.token)
+		if (err != nil) != test.expectListenErr {
+			t.Errorf("controlListenAddr(%#v, %#v) error = %v", test.addr, test.token, err)
+			continue
+		}
+		if network != test.network || laddr != test.laddr {
+			t.Errorf("controlListenAddr(%#v, %#v) = %s %s, expected %s %s",
+				test.addr, test.token, network, laddr, test.network, test.laddr)
+		}
+	}
+}
+
+func TestControlToken(t *testing.T) {
+	l := newTestSync()
+	l.ControlToken = "secret"
+	handler := l.authHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		auth     string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/status", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		handler.ServeHTTP(w, req)
+		if w.Code != test.expected {
+			t.Errorf("Authorization %#v: status %d, expected %d", test.auth, w.Code, test.expected)
+		}
+	}
+}
+
+func TestListenPrivateUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isync-control-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "isync.sock")
+	// A stale socket from an earlier run is replaced:
+	if err = ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := listenPrivateUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket: %v", path, info.Mode())
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("%s has permissions %v, want 0600", path, perm)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("listenPrivateUnix left %d entries in %s, want only the socket", len(entries), dir)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal("dial control socket:", err)
+	}
+	conn.Close()
+}
@@ -2,13 +2,18 @@ package isync
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/crawl/go-sequell/crawl/data"
@@ -29,8 +34,18 @@ const (
 	commandExit   = "exit"
 )
 
+// loadRetryInterval is how often isync retries loading logs whose last load
+// failed.
+const loadRetryInterval = time.Minute
+
 var errExit = errors.New("exit")
 
+// A fetchRequest is a request to fetch logs matching any of the filters, or
+// all logs if there are no filters.
+type fetchRequest struct {
+	filters []string
+}
+
 // Sync is the master isync state object, keeping track of the logs to sync, the
 // database and the log fetcher.
 type Sync struct {
@@ -42,14 +57,65 @@ type Sync struct {
 	Schema    *db.CrawlSchema
 	CrawlData data.Crawl
 	Fetcher   *logfetch.Fetcher
+	OnRewrite loader.RewritePolicy
+
+	// ControlAddr is the address of the HTTP control server: either a TCP
+	// host:port, or unix:/path/to/socket. If empty, no control server is
+	// started. A TCP address without a host listens on localhost.
+	ControlAddr string
+
+	// ControlToken, if set, must be sent by control clients as a bearer
+	// token. A token is required to serve the control API on a host other
+	// than localhost.
+	ControlToken string
+
+	// FetchInterval is how often live logs are fetched from servers that
+	// don't set their own fetch-interval in sources.yml. If 0, only servers
+	// with a fetch-interval are fetched automatically.
+	FetchInterval time.Duration
+
+	// LogPollInterval, if non-zero, makes isync poll log directories for
+	// changes at this interval instead of relying on inotify, which does not
+	// work on network filesystems.
+	LogPollInterval time.Duration
+
+	// Daemon runs isync without reading commands from stdin. A daemon
+	// reloads its config on SIGHUP, fetches logs on SIGUSR1, and runs until
+	// its context is cancelled or exit is requested through the control
+	// server.
+	Daemon bool
 
 	logFileWatcher     *fnotify.Notifier
 	configWatcher      *fnotify.Notifier
+	controlServer      *http.Server
+	status             *syncStatus
+	scheduler          *Scheduler
+	slaveCtx           context.Context
+	cancelSlaves       context.CancelFunc
+	cancelWatchers     context.CancelFunc
+	cancelMasters      context.CancelFunc
 	slaveWaitGroup     sync.WaitGroup
+	watchWaitGroup     sync.WaitGroup
 	masterWaitGroup    sync.WaitGroup
-	fetchRequests      chan bool
+	fetchRequests      chan *fetchRequest
+	resumeRequests     chan bool
+	exitRequests       chan bool
+	scheduleWake       chan bool
 	changedLogFiles    chan string
 	changedConfigFiles chan string
+	reloadRequests     chan bool
+	configUpdates      chan *configUpdate
+
+	// fetchedFiles is the set of fetched files that changed and are not yet
+	// loaded; fetchedWake is signalled when files are added. fetchingFiles
+	// maps each file being fetched to the cancel functions of its fetches,
+	// by fetch id: changes to these files are loaded when their fetch
+	// completes, not as they are written.
+	fetchedMutex  sync.Mutex
+	fetchedFiles  map[string]bool
+	fetchingFiles map[string]map[int]context.CancelFunc
+	lastFetchID   int
+	fetchedWake   chan bool
 }
 
 // New creates a new sync object given a database connection spec and a
@@ -65,10 +131,21 @@ func New(c pg.ConnSpec, cachedir string) (*Sync, error) {
 		CacheDir:           cachedir,
 		CrawlData:          data.CrawlData(),
 		Fetcher:            logfetch.New(),
+		status:             newSyncStatus(),
+		scheduler:          NewScheduler(0, time.Now().UnixNano()),
 		changedLogFiles:    make(chan string),
 		changedConfigFiles: make(chan string),
-		fetchRequests:      make(chan bool, 1),
+		reloadRequests:     make(chan bool, 1),
+		configUpdates:      make(chan *configUpdate),
+		fetchRequests:      make(chan *fetchRequest, 1),
+		resumeRequests:     make(chan bool, 1),
+		exitRequests:       make(chan bool, 1),
+		scheduleWake:       make(chan bool, 1),
+		fetchedFiles:       map[string]bool{},
+		fetchingFiles:      map[string]map[int]context.CancelFunc{},
+		fetchedWake:        make(chan bool, 1),
 	}
+	l.Fetcher.HTTPFetch.OnResult = l.recordFetchResult
 	if err = l.init(); err != nil {
 		return nil, err
 	}
@@ -88,6 +165,7 @@ func (l *Sync) setServers() error {
 		return err
 	}
 	l.Servers = servers
+	l.status.setXlogs(servers.XlogSources())
 	return nil
 }
 
@@ -106,13 +184,20 @@ func (l *Sync) gameTypePrefixes() map[string]string {
 
 func (l *Sync) newLoader() *loader.Loader {
 	norm := xlogtools.MustBuildNormalizer(l.CrawlData.YAML)
-	return loader.New(l.DB, l.Servers, l.Schema, norm, l.gameTypePrefixes())
+	ldr := loader.New(l.DB, l.Servers, l.Schema, norm, l.gameTypePrefixes())
+	ldr.OnRewrite = l.OnRewrite
+	return ldr
 }
 
-// Run monitors stdin for commands.
-func (l *Sync) Run() error {
-	l.startBackgroundTasks()
-	reader := bufio.NewReader(os.Stdin)
+// Run monitors stdin for commands. If the control server is enabled, Run
+// keeps running after stdin is closed, until exit is requested through the
+// control server. In daemon mode, Run ignores stdin and is controlled by
+// signals instead. Run shuts down isync when ctx is cancelled, abandoning
+// fetches and loads in progress.
+func (l *Sync) Run(ctx context.Context) error {
+	if err := l.startBackgroundTasks(ctx); err != nil {
+		return err
+	}
 
 	normalShutdown := func() error {
 		fmt.Println("Cleaning up...")
@@ -120,21 +205,81 @@ func (l *Sync) Run() error {
 		fmt.Println("Exiting.")
 		return nil
 	}
+	var stdinDone chan error
+	var signals chan os.Signal
+	if l.Daemon {
+		log.Println("Running as daemon: SIGHUP reloads config, SIGUSR1 fetches logs, SIGTERM exits")
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+		defer signal.Stop(signals)
+	} else {
+		stdinDone = make(chan error, 1)
+		go l.readCommands(os.Stdin, stdinDone)
+	}
+	for {
+		select {
+		case sig := <-signals:
+			l.handleSignal(sig)
+		case err := <-stdinDone:
+			if err == errExit {
+				return normalShutdown()
+			}
+			if err != io.EOF {
+				return err
+			}
+			if l.controlServer == nil {
+				return normalShutdown()
+			}
+			log.Println("stdin closed; waiting for exit request on control server")
+			stdinDone = nil
+		case <-l.exitRequests:
+			return normalShutdown()
+		case <-ctx.Done():
+			log.Println("Shutdown requested:", ctx.Err())
+			return normalShutdown()
+		}
+	}
+}
+
+// handleSignal handles a control signal received in daemon mode.
+func (l *Sync) handleSignal(sig os.Signal) {
+	switch sig {
+	case syscall.SIGHUP:
+		log.Println("SIGHUP: reloading config")
+		l.requestReload()
+	case syscall.SIGUSR1:
+		log.Println("SIGUSR1: fetching logs")
+		if !l.requestFetch(nil) {
+			log.Println("fetch already pending, ignoring SIGUSR1")
+		}
+	}
+}
+
+// requestReload asks the config reloader to reload sources.yml and
+// crawl-data.yml. requestReload does not wait for the reloader: requests
+// made while a request is already pending are merged with it.
+func (l *Sync) requestReload() {
+	select {
+	case l.reloadRequests <- true:
+	default:
+	}
+}
+
+// readCommands runs commands read from r until r is exhausted or a command
+// fails, and writes the final error (io.EOF at the end of r) to done.
+func (l *Sync) readCommands(r io.Reader, done chan<- error) {
+	reader := bufio.NewReader(r)
 	for {
 		line, err := reader.ReadString('\n')
 		if line != "" {
 			if err := l.runCommand(strings.TrimSpace(line)); err != nil {
-				if err == errExit {
-					return normalShutdown()
-				}
-				return err
+				done <- err
+				return
 			}
 		}
 		if err != nil {
-			if err == io.EOF {
-				return normalShutdown()
-			}
-			return err
+			done <- err
+			return
 		}
 	}
 }
@@ -147,10 +292,7 @@ func (l *Sync) Shutdown() {
 func (l *Sync) runCommand(cmd string) error {
 	switch strings.ToLower(cmd) {
 	case "fetch":
-		select {
-		case l.fetchRequests <- true:
-		default:
-		}
+		l.requestFetch(nil)
 	case "exit":
 		return errExit
 	default:
@@ -159,95 +301,427 @@ func (l *Sync) runCommand(cmd string) error {
 	return nil
 }
 
-func (l *Sync) startBackgroundTasks() {
-	l.startMasterTasks()
-	l.startSlaveTasks()
+// requestFetch queues a fetch of all logs matching any of filters, returning
+// false if a fetch is already pending.
+func (l *Sync) requestFetch(filters []string) bool {
+	select {
+	case l.fetchRequests <- &fetchRequest{filters: filters}:
+		l.status.recordFetchRequest()
+		return true
+	default:
+		return false
+	}
+}
+
+// pauseLoading stops loading changed logs until resumeLoading is called.
+// Logs continue to be fetched while loading is paused.
+func (l *Sync) pauseLoading() {
+	log.Println("Pausing log loading")
+	l.status.setPaused(true)
+}
+
+// resumeLoading resumes loading logs, loading all logs that changed while
+// loading was paused.
+func (l *Sync) resumeLoading() {
+	log.Println("Resuming log loading")
+	l.status.setPaused(false)
+	select {
+	case l.resumeRequests <- true:
+	default:
+	}
+}
+
+// startBackgroundTasks starts the master tasks, which run until isync
+// exits, and the slave tasks, which are restarted when the config changes.
+// Master tasks are cancelled with ctx or by stopMasterTasks; slave tasks are
+// cancelled with the master tasks or by stopSlaveTasks.
+func (l *Sync) startBackgroundTasks(ctx context.Context) error {
+	masterCtx, cancel := context.WithCancel(ctx)
+	l.cancelMasters = cancel
+	if err := l.startMasterTasks(masterCtx); err != nil {
+		return err
+	}
+	l.startSlaveTasks(masterCtx)
+	return nil
 }
 
-func (l *Sync) startMasterTasks() {
-	l.monitorConfigs()
+func (l *Sync) startMasterTasks(ctx context.Context) error {
+	l.monitorConfigs(ctx)
 	l.masterWaitGroup.Add(1)
-	go l.reloadConfigs()
+	go l.reloadConfigs(ctx)
+	return l.startControlServer()
 }
 
-func (l *Sync) startSlaveTasks() {
+// startSlaveTasks starts the log loader and the watch tasks. Slave tasks are
+// restarted when the schema changes; the watch tasks alone are restarted
+// when the list of logs changes.
+func (l *Sync) startSlaveTasks(masterCtx context.Context) {
 	log.Printf("startSlaveTasks...\n")
-	// The three main goroutines that need to be restarted when a
-	// config changes:
-	l.monitorLogs()
-	l.slaveWaitGroup.Add(2)
-	go l.readLogs()
-	go l.monitorFetchRequests()
-}
-
-func (l *Sync) monitorFetchRequests() {
-	for fetch := range l.fetchRequests {
-		if !fetch {
-			break
+	ctx, cancel := context.WithCancel(masterCtx)
+	l.slaveCtx = ctx
+	l.cancelSlaves = cancel
+	l.slaveWaitGroup.Add(1)
+	go l.readLogs(ctx)
+	l.startWatchTasks()
+}
+
+// startWatchTasks starts the tasks that watch logs for changes and start
+// fetches: these use l.Servers, and are cheap to restart. The fetches
+// themselves run in the slave context, so that restarting the watch tasks
+// does not abandon them.
+func (l *Sync) startWatchTasks() {
+	ctx, cancel := context.WithCancel(l.slaveCtx)
+	l.cancelWatchers = cancel
+	l.monitorLogs(ctx)
+	l.watchWaitGroup.Add(2)
+	go l.monitorFetchRequests(ctx, l.slaveCtx)
+	go l.scheduleFetches(ctx, l.slaveCtx)
+}
+
+func (l *Sync) monitorFetchRequests(ctx, fetchCtx context.Context) {
+	defer l.watchWaitGroup.Done()
+	for {
+		select {
+		case req := <-l.fetchRequests:
+			l.download(fetchCtx, sources.FilterXlogs(l.Servers.XlogSources(), req.filters), nil)
+		case <-ctx.Done():
+			log.Println("fetch request monitor exiting")
+			return
 		}
-		l.Fetcher.Download(l.Servers.XlogSources(), true)
 	}
-	log.Println("fetch request monitor exiting")
-	l.slaveWaitGroup.Done()
 }
 
 func (l *Sync) stopAllTasks() {
+	l.stopControlServer()
 	l.stopSlaveTasks()
 	l.stopMasterTasks()
 }
 
 func (l *Sync) stopMasterTasks() {
-	l.configWatcher.Close()
-	l.changedConfigFiles <- ""
+	l.cancelMasters()
 	l.masterWaitGroup.Wait()
 }
 
 func (l *Sync) stopSlaveTasks() {
 	log.Printf("stopSlaveTasks...\n")
-	// Sentinel to shut down the log reader and fetch monitor:
-	l.changedLogFiles <- ""
-	l.fetchRequests <- false
-	l.logFileWatcher.Close()
+	l.cancelSlaves()
+	l.watchWaitGroup.Wait()
 	l.slaveWaitGroup.Wait()
 }
 
-func (l *Sync) reloadConfigs() {
-	for cfg := range l.changedConfigFiles {
-		if cfg == "" {
-			break
+func (l *Sync) stopWatchTasks() {
+	l.cancelWatchers()
+	l.watchWaitGroup.Wait()
+}
+
+// A configUpdate is a change to the logs loaded by readLogs that does not
+// require a full reload.
+type configUpdate struct {
+	servers sources.Servers
+	added   []*sources.XlogSrc
+	removed []*sources.XlogSrc
+
+	// norm is the new log normalizer, or nil if crawl-data.yml is
+	// unchanged.
+	norm *xlogtools.Normalizer
+
+	// applied is closed when readLogs has applied the update.
+	applied chan struct{}
+}
+
+func (l *Sync) reloadConfigs(ctx context.Context) {
+	defer l.masterWaitGroup.Done()
+	sourcesConfig := resource.Root.Path("config/sources.yml")
+	for {
+		crawlDataChanged := true
+		select {
+		case cfg := <-l.changedConfigFiles:
+			log.Printf("Config %s changed, reloading\n", cfg)
+			crawlDataChanged = cfg != sourcesConfig
+		case <-l.reloadRequests:
+			log.Println("Config reload requested, reloading")
+		case <-ctx.Done():
+			log.Println("config reload monitor exiting")
+			return
 		}
-		log.Printf("Config %s changed, reloading\n", cfg)
+		if err := l.reloadConfig(ctx, crawlDataChanged); err != nil {
+			log.Println("Error reloading config, keeping current config:", err)
+			l.status.recordError(err)
+		}
+	}
+}
+
+// reloadConfig reloads sources.yml and crawl-data.yml. If the schema or the
+// game type prefixes changed, all slave tasks are restarted and all logs are
+// rescanned. Otherwise only the readers for added, removed, or changed logs
+// are updated, and the log normalizer is rebuilt if crawlDataChanged.
+func (l *Sync) reloadConfig(ctx context.Context, crawlDataChanged bool) error {
+	crawlData := data.CrawlData()
+	servers, err := sources.Sources(data.Sources(), crawlData, l.CacheDir)
+	if err != nil {
+		return err
+	}
+	schema, err := db.LoadSchema(crawlData.YAML)
+	if err != nil {
+		return err
+	}
+
+	if schema.Schema().Hash() != l.Schema.Schema().Hash() ||
+		!reflect.DeepEqual(crawlData.StringMap("game-type-prefixes"), l.gameTypePrefixes()) {
+		log.Println("Schema changed, restarting all tasks")
 		l.stopSlaveTasks()
-		l.CrawlData = data.CrawlData()
-		l.setServers()
-		l.setSchema()
-		l.startSlaveTasks()
+		l.CrawlData = crawlData
+		l.Schema = schema
+		l.Servers = servers
+		l.status.setXlogs(servers.XlogSources())
+		l.startSlaveTasks(ctx)
+		return nil
+	}
+
+	update := &configUpdate{
+		servers: servers,
+		applied: make(chan struct{}),
+	}
+	update.added, update.removed = sources.DiffXlogs(l.Servers.XlogSources(), servers.XlogSources())
+	if crawlDataChanged {
+		if update.norm, err = xlogtools.BuildNormalizer(crawlData.YAML); err != nil {
+			return err
+		}
+	}
+	log.Printf("Config reload: %d logs added, %d removed, normalizer %s\n",
+		len(update.added), len(update.removed), changedText(update.norm != nil))
+
+	l.stopWatchTasks()
+	// Fetches of unchanged logs continue; fetches of logs that were removed
+	// or changed are abandoned:
+	for _, x := range update.removed {
+		l.cancelFetches(x.TargetPath)
+	}
+	l.CrawlData = crawlData
+	l.Servers = servers
+	l.status.setXlogs(servers.XlogSources())
+	select {
+	case l.configUpdates <- update:
+		<-update.applied
+	case <-l.slaveCtx.Done():
+		return nil
+	}
+	l.startWatchTasks()
+	return nil
+}
+
+func changedText(changed bool) string {
+	if changed {
+		return "rebuilt"
 	}
-	log.Println("config reload monitor exiting")
-	l.masterWaitGroup.Done()
+	return "unchanged"
 }
 
-func (l *Sync) readLogs() {
-	log.Println("Loading logs into", l.ConnSpec.Database)
+func (l *Sync) readLogs(ctx context.Context) {
+	defer l.slaveWaitGroup.Done()
 	l.Loader = l.newLoader()
-	if err := l.Loader.LoadCommit(); err != nil {
-		log.Println("Error preloading logs:", err)
+	preloaded := false
+	preload := func() {
+		log.Println("Loading logs into", l.ConnSpec.Database)
+		if err := l.Loader.LoadCommit(ctx); err != nil && ctx.Err() == nil {
+			log.Println("Error preloading logs:", err)
+			l.status.recordError(err)
+		}
+		preloaded = true
+	}
+	if !l.status.isPaused() {
+		preload()
 	}
 
-	for file := range l.changedLogFiles {
-		// Sentinel:
-		if file == "" {
-			break
+	// Logs that changed while loading was paused, and logs whose last load
+	// failed:
+	pendingFiles := map[string]bool{}
+	failedFiles := map[string]bool{}
+	logChanged := func(file string) {
+		if l.status.isPaused() {
+			pendingFiles[file] = true
+			return
+		}
+		if err := l.loadChangedLog(ctx, file); err != nil {
+			failedFiles[file] = true
+		} else {
+			delete(failedFiles, file)
 		}
-		if err := l.Loader.LoadCommitLog(file); err != nil {
-			log.Printf("Error reading changed log %s: %s\n", file, err)
+	}
+	retry := time.NewTicker(loadRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("log loader exiting")
+			return
+		case file := <-l.changedLogFiles:
+			// Files being fetched are loaded when their fetch completes:
+			if l.isFetching(file) {
+				continue
+			}
+			logChanged(file)
+		case <-retry.C:
+			for file := range failedFiles {
+				logChanged(file)
+			}
+		case <-l.fetchedWake:
+			for _, file := range l.takeFetchedFiles() {
+				logChanged(file)
+			}
+		case update := <-l.configUpdates:
+			for _, file := range l.applyConfigUpdate(update) {
+				logChanged(file)
+			}
+		case <-l.resumeRequests:
+			if l.status.isPaused() {
+				continue
+			}
+			if !preloaded {
+				preload()
+				pendingFiles = map[string]bool{}
+				continue
+			}
+			for file := range pendingFiles {
+				delete(pendingFiles, file)
+				logChanged(file)
+			}
 		}
 	}
-	log.Println("log loader exiting")
-	l.slaveWaitGroup.Done()
 }
 
-func (l *Sync) monitorConfigs() {
+// applyConfigUpdate updates the loader's readers and normalizer, returning
+// the target paths of the added logs, which must be loaded.
+func (l *Sync) applyConfigUpdate(update *configUpdate) []string {
+	defer close(update.applied)
+	l.Loader.Servers = update.servers
+	if update.norm != nil {
+		l.Loader.LogNorm = update.norm
+	}
+	for _, x := range update.removed {
+		l.Loader.RemoveReader(x.TargetPath)
+	}
+	added := make([]string, len(update.added))
+	for i, x := range update.added {
+		l.Loader.AddReader(x)
+		added[i] = x.TargetPath
+	}
+	return added
+}
+
+// loadChangedLog loads the new lines in file, returning the load error, if
+// any. Cancelled loads are not errors.
+func (l *Sync) loadChangedLog(ctx context.Context, file string) error {
+	// Files such as fetch metadata sidecars share directories with logs:
+	if l.Loader.FindReader(file) == nil {
+		return nil
+	}
+	err := l.Loader.LoadCommitLog(ctx, file)
+	if ctx.Err() != nil {
+		// Cancelled loads are rolled back, and loaded again on restart.
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error reading changed log %s: %s\n", file, err)
+	}
+	l.status.recordLoad(file, err)
+	return err
+}
+
+// download fetches xlogs in the background, each in its own context
+// derived from ctx, so that fetches of single files can be cancelled. While
+// a file is being fetched, changes to it are not loaded as they are written;
+// the file is loaded when its fetch completes, if the fetch changed it. If
+// done is not nil, it is called with each file's fetch error (or nil) when
+// the file's fetch completes.
+func (l *Sync) download(ctx context.Context, xlogs []*sources.XlogSrc, done func(file string, err error)) {
+	for _, x := range xlogs {
+		fetchCtx, cancel := context.WithCancel(ctx)
+		id := l.startFetching(x.TargetPath, cancel)
+		results := l.Fetcher.Download(fetchCtx, []*sources.XlogSrc{x}, true)
+		go func(file string) {
+			var err error
+			for res := range results {
+				if res.Err != nil {
+					err = res.Err
+				}
+			}
+			l.doneFetching(file, id)
+			if done != nil {
+				done(file, err)
+			}
+		}(x.TargetPath)
+	}
+}
+
+// startFetching marks file as being fetched by a fetch that is cancelled
+// by cancel, returning the fetch's id.
+func (l *Sync) startFetching(file string, cancel context.CancelFunc) int {
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	l.lastFetchID++
+	if l.fetchingFiles[file] == nil {
+		l.fetchingFiles[file] = map[int]context.CancelFunc{}
+	}
+	l.fetchingFiles[file][l.lastFetchID] = cancel
+	return l.lastFetchID
+}
+
+// doneFetching records that the fetch of file with the given id is
+// complete.
+func (l *Sync) doneFetching(file string, id int) {
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	if cancel := l.fetchingFiles[file][id]; cancel != nil {
+		// Release the fetch's context:
+		cancel()
+		delete(l.fetchingFiles[file], id)
+	}
+	if len(l.fetchingFiles[file]) == 0 {
+		delete(l.fetchingFiles, file)
+	}
+}
+
+// cancelFetches cancels the fetches of file in progress.
+func (l *Sync) cancelFetches(file string) {
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	for _, cancel := range l.fetchingFiles[file] {
+		cancel()
+	}
+}
+
+// isFetching returns true if isync is fetching file.
+func (l *Sync) isFetching(file string) bool {
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	return len(l.fetchingFiles[file]) > 0
+}
+
+// addFetchedFile queues file to be loaded after a fetch changed it.
+func (l *Sync) addFetchedFile(file string) {
+	l.fetchedMutex.Lock()
+	l.fetchedFiles[file] = true
+	l.fetchedMutex.Unlock()
+	select {
+	case l.fetchedWake <- true:
+	default:
+	}
+}
+
+// takeFetchedFiles returns and clears the set of changed fetched files.
+func (l *Sync) takeFetchedFiles() []string {
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	files := make([]string, 0, len(l.fetchedFiles))
+	for file := range l.fetchedFiles {
+		files = append(files, file)
+	}
+	l.fetchedFiles = map[string]bool{}
+	return files
+}
+
+func (l *Sync) monitorConfigs(ctx context.Context) {
 	configs := []string{
 		resource.Root.Path("config/sources.yml"),
 		resource.Root.Path("config/crawl-data.yml"),
@@ -256,20 +730,21 @@ func (l *Sync) monitorConfigs() {
 	l.configWatcher.Debounce = time.Millisecond * 5000
 	l.masterWaitGroup.Add(1)
 	go func() {
-		l.configWatcher.Notify(configs, l.changedConfigFiles)
+		l.configWatcher.Notify(ctx, configs, l.changedConfigFiles)
 		log.Println("config monitor exiting")
 		l.masterWaitGroup.Done()
 	}()
 }
 
-func (l *Sync) monitorLogs() {
+func (l *Sync) monitorLogs(ctx context.Context) {
 	l.logFileWatcher = fnotify.New("logs")
-	l.slaveWaitGroup.Add(1)
+	l.logFileWatcher.PollInterval = l.LogPollInterval
+	l.watchWaitGroup.Add(1)
 	l.Servers.MkdirTargets()
 	go func() {
-		l.logFileWatcher.Notify(l.Servers.TargetLogDirs(), l.changedLogFiles)
+		l.logFileWatcher.Notify(ctx, l.Servers.TargetLogDirs(), l.changedLogFiles)
 		log.Println("log monitor exiting")
-		l.slaveWaitGroup.Done()
+		l.watchWaitGroup.Done()
 	}()
 }
 
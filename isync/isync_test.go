@@ -0,0 +1,85 @@
+package isync
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/crawl/go-sequell/loader"
+	"github.com/crawl/go-sequell/sources"
+)
+
+func TestApplyConfigUpdate(t *testing.T) {
+	cao := &sources.Server{Name: "cao"}
+	logfile := &sources.XlogSrc{Server: cao, TargetPath: "cao/logfile-git"}
+	milestones := &sources.XlogSrc{Server: cao, TargetPath: "cao/milestones-git"}
+
+	l := newTestSync()
+	l.Loader = &loader.Loader{}
+	readerFiles := func() []string {
+		files := []string{}
+		for _, r := range l.Loader.Readers {
+			files = append(files, r.TargetPath)
+		}
+		return files
+	}
+
+	update := &configUpdate{
+		added:   []*sources.XlogSrc{logfile, milestones},
+		applied: make(chan struct{}),
+	}
+	added := l.applyConfigUpdate(update)
+	<-update.applied
+	if expected := []string{"cao/logfile-git", "cao/milestones-git"}; !reflect.DeepEqual(added, expected) {
+		t.Errorf("applyConfigUpdate returned %#v, expected %#v", added, expected)
+	}
+
+	update = &configUpdate{
+		removed: []*sources.XlogSrc{logfile},
+		applied: make(chan struct{}),
+	}
+	if added := l.applyConfigUpdate(update); len(added) != 0 {
+		t.Errorf("applyConfigUpdate returned %#v, expected no logs to load", added)
+	}
+	if files, expected := readerFiles(), []string{"cao/milestones-git"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("readers after update: %#v, expected %#v", files, expected)
+	}
+	if l.Loader.FindReader("cao/logfile-git") != nil {
+		t.Errorf("reader for removed log still present")
+	}
+}
+
+func TestFetchingFiles(t *testing.T) {
+	l := newTestSync()
+	cancelled := map[int]bool{}
+	cancelFunc := func(id int) context.CancelFunc {
+		return func() { cancelled[id] = true }
+	}
+	logfile1 := l.startFetching("cao/logfile", cancelFunc(1))
+	milestones := l.startFetching("cao/milestones", cancelFunc(2))
+	logfile2 := l.startFetching("cao/logfile", cancelFunc(3))
+	if !l.isFetching("cao/logfile") || !l.isFetching("cao/milestones") {
+		t.Errorf("files not marked as being fetched")
+	}
+	if l.isFetching("cue/logfile") {
+		t.Errorf("cue/logfile marked as being fetched")
+	}
+
+	l.cancelFetches("cao/logfile")
+	if !cancelled[1] || cancelled[2] || !cancelled[3] {
+		t.Errorf("cancelFetches(cao/logfile) cancelled %v, expected fetches 1 and 3", cancelled)
+	}
+
+	l.doneFetching("cao/logfile", logfile1)
+	l.doneFetching("cao/milestones", milestones)
+	if !l.isFetching("cao/logfile") {
+		t.Errorf("cao/logfile not being fetched after one of two fetches completed")
+	}
+	if l.isFetching("cao/milestones") {
+		t.Errorf("cao/milestones still being fetched after its fetch completed")
+	}
+	l.doneFetching("cao/logfile", logfile2)
+	if l.isFetching("cao/logfile") {
+		t.Errorf("cao/logfile still being fetched after both fetches completed")
+	}
+}
@@ -0,0 +1,318 @@
+package isync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crawl/go-sequell/httpfetch"
+	"github.com/crawl/go-sequell/sources"
+)
+
+// Scheduler defaults.
+const (
+	// DefaultFetchJitter is the default fraction of a fetch interval by which
+	// fetches are randomly offset, so that servers with the same interval
+	// are not all fetched at the same time.
+	DefaultFetchJitter = 0.1
+
+	// DefaultMaxFetchBackoff is the longest delay between fetches of a
+	// server whose fetches keep failing.
+	DefaultMaxFetchBackoff = time.Hour
+
+	// DefaultFetchTimeout is how long a scheduled fetch may be in progress
+	// before it is treated as failed.
+	DefaultFetchTimeout = 30 * time.Minute
+)
+
+// A Scheduler decides when each server's live logs are next due to be
+// fetched. Servers are fetched at their FetchInterval (or the scheduler's
+// DefaultInterval), with random jitter. Servers whose last fetch failed are
+// backed off exponentially, up to MaxBackoff. All methods are safe for
+// concurrent use.
+type Scheduler struct {
+	DefaultInterval time.Duration
+	Jitter          float64
+	MaxBackoff      time.Duration
+	FetchTimeout    time.Duration
+
+	mutex       sync.Mutex
+	rand        *rand.Rand
+	servers     map[string]*serverSchedule
+	lastFetchID int
+}
+
+// serverSchedule is the fetch schedule for a single server.
+type serverSchedule struct {
+	interval time.Duration
+	next     time.Time
+	failures int
+
+	// fetchID identifies the last scheduled fetch, and pending is the
+	// number of its fetch results outstanding.
+	fetchID int
+	pending int
+	failed  bool
+	started time.Time
+}
+
+// NewScheduler creates a scheduler that fetches servers every
+// defaultInterval unless they specify their own interval. If defaultInterval
+// is 0, only servers with an explicit interval are scheduled. seed seeds the
+// scheduler's jitter.
+func NewScheduler(defaultInterval time.Duration, seed int64) *Scheduler {
+	return &Scheduler{
+		DefaultInterval: defaultInterval,
+		Jitter:          DefaultFetchJitter,
+		MaxBackoff:      DefaultMaxFetchBackoff,
+		FetchTimeout:    DefaultFetchTimeout,
+		rand:            rand.New(rand.NewSource(seed)),
+		servers:         map[string]*serverSchedule{},
+	}
+}
+
+// SetServers sets the servers to be scheduled. Servers that are already
+// scheduled keep their schedule and backoff state; new servers are first
+// fetched at a random point within their interval.
+func (s *Scheduler) SetServers(servers sources.Servers, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	scheduled := map[string]*serverSchedule{}
+	for _, server := range servers {
+		interval := server.FetchInterval
+		if interval == 0 {
+			interval = s.DefaultInterval
+		}
+		if interval <= 0 || len(liveRemoteXlogs(server)) == 0 {
+			continue
+		}
+
+		sched := s.servers[server.Name]
+		if sched == nil {
+			sched = &serverSchedule{
+				next: now.Add(time.Duration(s.rand.Int63n(int64(interval)))),
+			}
+		} else if interval < sched.interval && sched.pending == 0 {
+			if next := now.Add(interval); next.Before(sched.next) {
+				sched.next = next
+			}
+		}
+		sched.interval = interval
+		scheduled[server.Name] = sched
+	}
+	s.servers = scheduled
+}
+
+// Empty returns true if no servers are scheduled.
+func (s *Scheduler) Empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.servers) == 0
+}
+
+// NextDue returns the time at which the next server is due to be fetched,
+// and false if no server is waiting to be fetched.
+func (s *Scheduler) NextDue() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var next time.Time
+	found := false
+	for _, sched := range s.servers {
+		due := sched.next
+		if sched.pending > 0 {
+			due = sched.started.Add(s.FetchTimeout)
+		}
+		if !found || due.Before(next) {
+			next, found = due, true
+		}
+	}
+	return next, found
+}
+
+// Due returns the names of the servers that are due to be fetched at now,
+// in sorted order.
+func (s *Scheduler) Due(now time.Time) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	due := []string{}
+	for name, sched := range s.servers {
+		if sched.pending > 0 {
+			if now.Sub(sched.started) < s.FetchTimeout {
+				continue
+			}
+			// The fetch timed out, and is backed off like a failed fetch:
+			sched.pending = 0
+			sched.failed = true
+			s.reschedule(sched, now)
+			continue
+		}
+		if !now.Before(sched.next) {
+			due = append(due, name)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// Start records that a fetch of nfiles files from server has started, and
+// returns the fetch's id. The server is not due again until Done has been
+// called with the id for every file.
+func (s *Scheduler) Start(server string, nfiles int, now time.Time) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sched := s.servers[server]
+	if sched == nil {
+		return 0
+	}
+	s.lastFetchID++
+	sched.fetchID = s.lastFetchID
+	sched.pending = nfiles
+	sched.failed = false
+	sched.started = now
+	if nfiles == 0 {
+		s.reschedule(sched, now)
+	}
+	return sched.fetchID
+}
+
+// Done records the result of fetching one file in the scheduled fetch
+// fetchID of server. Results of other fetches (such as fetches requested by
+// hand, or scheduled fetches that timed out) are ignored. Once all files for
+// the scheduled fetch are done, the server is rescheduled: at its regular
+// interval if all files were fetched, or backed off if any failed. A
+// cancelled fetch is not a failure.
+func (s *Scheduler) Done(server string, fetchID int, err error, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sched := s.servers[server]
+	if sched == nil || sched.pending == 0 || sched.fetchID != fetchID {
+		return
+	}
+	sched.pending--
+	if err != nil && !errors.Is(err, context.Canceled) {
+		sched.failed = true
+	}
+	if sched.pending == 0 {
+		s.reschedule(sched, now)
+	}
+}
+
+// reschedule sets the next fetch time for sched after a completed fetch. The
+// caller must hold the mutex.
+func (s *Scheduler) reschedule(sched *serverSchedule, now time.Time) {
+	if sched.failed {
+		sched.failures++
+	} else {
+		sched.failures = 0
+	}
+	sched.next = now.Add(s.jitter(s.backoff(sched.interval, sched.failures)))
+}
+
+// backoff returns interval doubled for each consecutive failure, up to
+// MaxBackoff (or interval, if interval is longer than MaxBackoff).
+func (s *Scheduler) backoff(interval time.Duration, failures int) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < s.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > s.MaxBackoff && interval < s.MaxBackoff {
+		delay = s.MaxBackoff
+	}
+	return delay
+}
+
+// jitter offsets d by a random amount up to +/- s.Jitter * d.
+func (s *Scheduler) jitter(d time.Duration) time.Duration {
+	spread := int64(float64(d) * s.Jitter)
+	if spread <= 0 {
+		return d
+	}
+	return d + time.Duration(s.rand.Int63n(2*spread+1)-spread)
+}
+
+// liveRemoteXlogs returns the server's live logs that must be fetched from
+// the server.
+func liveRemoteXlogs(server *sources.Server) []*sources.XlogSrc {
+	res := []*sources.XlogSrc{}
+	for _, x := range server.Logfiles {
+		if x.NeedsFetch() {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// scheduleFetches fetches live logs from each server as its scheduled fetch
+// comes due, until ctx is cancelled. Fetches run in fetchCtx.
+func (l *Sync) scheduleFetches(ctx, fetchCtx context.Context) {
+	defer l.watchWaitGroup.Done()
+	l.scheduler.DefaultInterval = l.FetchInterval
+	l.scheduler.SetServers(l.Servers, time.Now())
+	if l.scheduler.Empty() {
+		log.Println("fetch scheduler: no servers to fetch on a schedule")
+	}
+
+	// With nothing due, check again after idleWait in case the schedule
+	// has changed.
+	const idleWait = time.Minute
+	timer := time.NewTimer(idleWait)
+	defer timer.Stop()
+	for {
+		wait := idleWait
+		if next, ok := l.scheduler.NextDue(); ok {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			log.Println("fetch scheduler exiting")
+			return
+		case <-l.scheduleWake:
+		case <-timer.C:
+			now := time.Now()
+			for _, name := range l.scheduler.Due(now) {
+				l.fetchServer(fetchCtx, name, now)
+			}
+		}
+	}
+}
+
+// fetchServer starts a scheduled fetch of the named server's live logs.
+func (l *Sync) fetchServer(ctx context.Context, name string, now time.Time) {
+	server := l.Servers.Server(name)
+	if server == nil {
+		return
+	}
+	xlogs := liveRemoteXlogs(server)
+	id := l.scheduler.Start(name, len(xlogs), now)
+	if len(xlogs) > 0 {
+		l.download(ctx, xlogs, func(file string, err error) {
+			l.scheduler.Done(name, id, err, time.Now())
+			select {
+			case l.scheduleWake <- true:
+			default:
+			}
+		})
+	}
+}
+
+// recordFetchResult records the result of a single file fetch, and queues
+// the file to be loaded if the fetch changed it.
+func (l *Sync) recordFetchResult(res *httpfetch.FetchResult) {
+	l.status.recordFetch(res)
+	if res.Changed() {
+		l.addFetchedFile(res.Req.Filename)
+	}
+}
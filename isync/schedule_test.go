@@ -0,0 +1,184 @@
+package isync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/crawl/go-sequell/logfetch"
+	"github.com/crawl/go-sequell/sources"
+)
+
+func testServer(name string, interval time.Duration) *sources.Server {
+	server := &sources.Server{Name: name, FetchInterval: interval}
+	server.Logfiles = []*sources.XlogSrc{
+		{Server: server, TargetPath: name + "/logfile", Live: true},
+		{Server: server, TargetPath: name + "/milestones", Live: true},
+		{Server: server, TargetPath: name + "/logfile-old"},
+	}
+	return server
+}
+
+func TestSchedulerIntervals(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewScheduler(10*time.Minute, 1)
+	s.SetServers(sources.Servers{
+		testServer("cao", 0),
+		testServer("cdo", time.Minute),
+		testServer("cwz", 0),
+	}, start)
+
+	if due := s.Due(start.Add(time.Minute)); !reflect.DeepEqual(due, []string{"cdo"}) {
+		t.Errorf("Due after 1m = %#v, expected [cdo]", due)
+	}
+	if due := s.Due(start.Add(10 * time.Minute)); !reflect.DeepEqual(due, []string{"cao", "cdo", "cwz"}) {
+		t.Errorf("Due after 10m = %#v, expected [cao cdo cwz]", due)
+	}
+
+	now := start.Add(10 * time.Minute)
+	id := s.Start("cdo", 2, now)
+	if due := s.Due(now); !reflect.DeepEqual(due, []string{"cao", "cwz"}) {
+		t.Errorf("Due with cdo fetch in progress = %#v, expected [cao cwz]", due)
+	}
+	// Results of other fetches do not complete the scheduled fetch:
+	s.Done("cdo", id+1, nil, now)
+	s.Done("cdo", id+1, nil, now)
+	if s.servers["cdo"].pending != 2 {
+		t.Errorf("other fetches counted against the scheduled fetch: %d pending, expected 2", s.servers["cdo"].pending)
+	}
+	s.Done("cdo", id, nil, now)
+	s.Done("cdo", id, nil, now)
+	next := s.servers["cdo"].next
+	if d := next.Sub(now); d < 54*time.Second || d > 66*time.Second {
+		t.Errorf("cdo rescheduled after %s, expected 1m +/- 10%%", d)
+	}
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewScheduler(0, 1)
+	s.Jitter = 0
+	s.MaxBackoff = 10 * time.Minute
+	s.SetServers(sources.Servers{testServer("cue", time.Minute)}, now)
+
+	fetch := func(err error) time.Duration {
+		id := s.Start("cue", 2, now)
+		s.Done("cue", id, nil, now)
+		s.Done("cue", id, err, now)
+		return s.servers["cue"].next.Sub(now)
+	}
+	failure := errors.New("connection refused")
+	for i, expected := range []time.Duration{
+		2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute,
+	} {
+		if d := fetch(failure); d != expected {
+			t.Errorf("failure %d: next fetch in %s, expected %s", i+1, d, expected)
+		}
+	}
+	if d := fetch(nil); d != time.Minute {
+		t.Errorf("after success: next fetch in %s, expected 1m", d)
+	}
+	cancelled := fmt.Errorf("fetch: %w", context.Canceled)
+	if d := fetch(cancelled); d != time.Minute {
+		t.Errorf("after cancelled fetch: next fetch in %s, expected 1m", d)
+	}
+}
+
+func TestSchedulerFetchTimeout(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewScheduler(time.Minute, 1)
+	s.Jitter = 0
+	s.SetServers(sources.Servers{testServer("cbro", 0)}, now)
+	s.Start("cbro", 2, now)
+	if next, ok := s.NextDue(); !ok || !next.Equal(now.Add(s.FetchTimeout)) {
+		t.Errorf("NextDue() = %s, %v, expected fetch timeout at %s", next, ok, now.Add(s.FetchTimeout))
+	}
+
+	now = now.Add(s.FetchTimeout)
+	if due := s.Due(now); len(due) != 0 {
+		t.Errorf("Due() after timeout = %#v, expected server to be backed off", due)
+	}
+	if d := s.servers["cbro"].next.Sub(now); d != 2*time.Minute {
+		t.Errorf("timed out fetch rescheduled in %s, expected 2m", d)
+	}
+}
+
+func TestScheduledAndManualFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "name=Inkie:xl=3")
+	}))
+	defer httpServer.Close()
+
+	server := testServer("cao", time.Minute)
+	for _, x := range server.Logfiles {
+		x.URL = httpServer.URL + "/" + x.TargetPath
+		x.TargetPath = filepath.Join(dir, x.TargetPath)
+	}
+
+	l := newTestSync()
+	l.Servers = sources.Servers{server}
+	l.Fetcher = logfetch.New()
+	l.Fetcher.HTTPFetch.OnResult = l.recordFetchResult
+	defer l.Fetcher.HTTPFetch.Shutdown()
+	l.scheduler = NewScheduler(0, 1)
+	l.scheduler.SetServers(l.Servers, time.Now())
+
+	// A scheduled fetch of the live logs, and a manual fetch of the old
+	// log, at the same time:
+	now := time.Now()
+	start := make(chan bool)
+	started := make(chan bool, 2)
+	go func() {
+		<-start
+		l.fetchServer(context.Background(), "cao", now)
+		started <- true
+	}()
+	go func() {
+		<-start
+		l.download(context.Background(), server.Logfiles[2:], nil)
+		started <- true
+	}()
+	close(start)
+	<-started
+	<-started
+
+	pending := func() int {
+		l.scheduler.mutex.Lock()
+		defer l.scheduler.mutex.Unlock()
+		return l.scheduler.servers["cao"].pending
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, x := range server.Logfiles {
+		for l.isFetching(x.TargetPath) || pending() > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("fetches did not complete: %d scheduled files pending", pending())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	l.scheduler.mutex.Lock()
+	defer l.scheduler.mutex.Unlock()
+	if sched := l.scheduler.servers["cao"]; sched.failures != 0 || !sched.next.After(now) {
+		t.Errorf("cao after fetch: %d failures, next fetch at %s; expected rescheduled after %s", sched.failures, sched.next, now)
+	}
+	l.fetchedMutex.Lock()
+	defer l.fetchedMutex.Unlock()
+	if len(l.fetchedFiles) != len(server.Logfiles) {
+		t.Errorf("fetched %d files, expected %d", len(l.fetchedFiles), len(server.Logfiles))
+	}
+}
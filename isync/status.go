@@ -0,0 +1,149 @@
+package isync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/crawl/go-sequell/httpfetch"
+	"github.com/crawl/go-sequell/sources"
+)
+
+// A FileStatus is the fetch and load status of a single xlog file.
+type FileStatus struct {
+	File           string     `json:"file"`
+	Path           string     `json:"path"`
+	URL            string     `json:"url,omitempty"`
+	Live           bool       `json:"live"`
+	Offset         *int64     `json:"offset"`
+	LastFetch      *time.Time `json:"last_fetch,omitempty"`
+	LastFetchSize  int64      `json:"last_fetch_size"`
+	LastFetchCode  int        `json:"last_fetch_status,omitempty"`
+	LastFetchTime  float64    `json:"last_fetch_seconds,omitempty"`
+	LastFetchError string     `json:"last_fetch_error,omitempty"`
+	LastLoad       *time.Time `json:"last_load,omitempty"`
+	LastLoadError  string     `json:"last_load_error,omitempty"`
+}
+
+// A Status is a snapshot of the state of an isync process.
+type Status struct {
+	Paused           bool          `json:"paused"`
+	StartedAt        time.Time     `json:"started_at"`
+	LastFetchRequest *time.Time    `json:"last_fetch_request,omitempty"`
+	LastError        string        `json:"last_error,omitempty"`
+	Files            []*FileStatus `json:"files"`
+}
+
+// syncStatus tracks the state of the isync process for status reports. All
+// methods are safe for concurrent use.
+type syncStatus struct {
+	sync.Mutex
+	paused           bool
+	startedAt        time.Time
+	lastFetchRequest *time.Time
+	lastError        string
+	xlogs            []*sources.XlogSrc
+	files            map[string]*FileStatus
+}
+
+func newSyncStatus() *syncStatus {
+	return &syncStatus{
+		startedAt: time.Now(),
+		files:     map[string]*FileStatus{},
+	}
+}
+
+// setXlogs sets the list of xlogs being tracked.
+func (s *syncStatus) setXlogs(xlogs []*sources.XlogSrc) {
+	s.Lock()
+	defer s.Unlock()
+	s.xlogs = xlogs
+}
+
+// file returns the status of the file at path. The caller must hold the
+// lock.
+func (s *syncStatus) file(path string) *FileStatus {
+	f := s.files[path]
+	if f == nil {
+		f = &FileStatus{Path: path}
+		s.files[path] = f
+	}
+	return f
+}
+
+func (s *syncStatus) setPaused(paused bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.paused = paused
+}
+
+func (s *syncStatus) isPaused() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.paused
+}
+
+func (s *syncStatus) recordFetchRequest() {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	s.lastFetchRequest = &now
+}
+
+func (s *syncStatus) recordFetch(res *httpfetch.FetchResult) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	f := s.file(res.Req.Filename)
+	f.LastFetch = &now
+	f.LastFetchSize = res.DownloadSize
+	f.LastFetchCode = res.StatusCode
+	f.LastFetchTime = res.Duration.Seconds()
+	f.LastFetchError = errorString(res.Err)
+}
+
+func (s *syncStatus) recordLoad(path string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	f := s.file(path)
+	f.LastLoad = &now
+	f.LastLoadError = errorString(err)
+}
+
+func (s *syncStatus) recordError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastError = errorString(err)
+}
+
+// snapshot returns the current status, with file offsets looked up in
+// offsets, which maps database filenames to their offsets.
+func (s *syncStatus) snapshot(offsets map[string]int64, dbFilename func(string) string) *Status {
+	s.Lock()
+	defer s.Unlock()
+	status := &Status{
+		Paused:           s.paused,
+		StartedAt:        s.startedAt,
+		LastFetchRequest: s.lastFetchRequest,
+		LastError:        s.lastError,
+		Files:            make([]*FileStatus, len(s.xlogs)),
+	}
+	for i, x := range s.xlogs {
+		f := *s.file(x.TargetPath)
+		f.File = x.TargetRelPath
+		f.URL = x.URL
+		f.Live = x.Live
+		if offset, ok := offsets[dbFilename(x.TargetRelPath)]; ok {
+			f.Offset = &offset
+		}
+		status.Files[i] = &f
+	}
+	return status
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,196 @@
+package loader
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/crawl/xlogtools"
+	"github.com/crawl/go-sequell/sources"
+	"github.com/crawl/go-sequell/xlog"
+	"github.com/pkg/errors"
+)
+
+// A RowWriter writes the rows that a load would insert into the database.
+type RowWriter interface {
+	// WriteRow writes a row of values for columns in table.
+	WriteRow(table string, columns []string, values []interface{}) error
+
+	// Flush writes any buffered rows.
+	Flush() error
+}
+
+// NewRowWriter creates a RowWriter that writes rows to w in format, which
+// may be "jsonl" or "csv".
+//
+// jsonl rows are JSON objects with the table name and an object mapping
+// column names to values. csv rows are prefixed with the table name, and a
+// header row naming the columns is written before the first row and
+// whenever the table changes.
+func NewRowWriter(format string, w io.Writer) (RowWriter, error) {
+	switch format {
+	case "jsonl":
+		bw := bufio.NewWriter(w)
+		return &jsonlRowWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case "csv":
+		return &csvRowWriter{w: csv.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown row format %#v: expected jsonl or csv", format)
+	}
+}
+
+type jsonlRowWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+type jsonlRow struct {
+	Table  string                 `json:"table"`
+	Values map[string]interface{} `json:"values"`
+}
+
+func (j *jsonlRowWriter) WriteRow(table string, columns []string, values []interface{}) error {
+	row := jsonlRow{Table: table, Values: make(map[string]interface{}, len(columns))}
+	for i, col := range columns {
+		row.Values[col] = values[i]
+	}
+	return j.enc.Encode(row)
+}
+
+func (j *jsonlRowWriter) Flush() error {
+	return j.w.Flush()
+}
+
+type csvRowWriter struct {
+	w         *csv.Writer
+	lastTable string
+	record    []string
+}
+
+func (c *csvRowWriter) WriteRow(table string, columns []string, values []interface{}) error {
+	if table != c.lastTable {
+		c.lastTable = table
+		if err := c.w.Write(append([]string{"table"}, columns...)); err != nil {
+			return err
+		}
+	}
+	c.record = append(c.record[:0], table)
+	for _, v := range values {
+		c.record = append(c.record, fmt.Sprint(v))
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *csvRowWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// NewDryRun creates a loader that reads and normalizes logs without a
+// database connection, for use with DryRun.
+func NewDryRun(srv sources.Servers, sch *db.CrawlSchema, norm *xlogtools.Normalizer, gameTypePrefixes map[string]string) *Loader {
+	l := &Loader{
+		Servers:          srv,
+		Schema:           sch,
+		gameTypePrefixes: gameTypePrefixes,
+		LogNorm:          norm,
+	}
+	xlogs := l.Servers.XlogSources()
+	l.Readers = make([]*Reader, len(xlogs))
+	for i, x := range xlogs {
+		l.Readers[i] = l.newReader(x)
+	}
+	l.initTableInsertFields()
+	return l
+}
+
+// dryRunKeys returns the xlog keys and column names for the fields of
+// baseTable, with lookup fields kept as text rather than resolved to ids.
+func (l *Loader) dryRunKeys(baseTable string) (keys, columns []string) {
+	fields := l.tableInsertFields[baseTable]
+	keys = make([]string, len(fields))
+	columns = make([]string, len(fields))
+	for i, f := range fields {
+		keys[i] = f.Name
+		columns[i] = f.SQLName
+	}
+	return keys, columns
+}
+
+// DryRun reads logs from all readers from offset from up to (but not
+// including) offset to, and writes the rows that would be inserted for them
+// to out, without touching the database. Lookup fields are written as text.
+// If from is non-zero, it must be the offset of the start of a line; if to
+// is 0, logs are read to the end. File offsets in l_file are ignored.
+func (l *Loader) DryRun(ctx context.Context, out RowWriter, from, to int64) error {
+	defer l.Close()
+	type tableKeys struct {
+		keys, columns []string
+	}
+	baseTableKeys := map[string]tableKeys{}
+	var row []interface{}
+	for _, reader := range l.Readers {
+		if from > 0 {
+			if err := reader.SeekOffset(from); err != nil {
+				if err == xlog.ErrNoFile {
+					log.Printf("Ignoring missing file: %s\n", reader.Filename)
+					continue
+				}
+				return errors.Wrapf(err, "SeekOffset:%s:%d", reader.Filename, from)
+			}
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			x, err := reader.Next()
+			if err == xlog.ErrNoFile {
+				log.Printf("Ignoring missing file: %s\n", reader.Filename)
+				break
+			}
+			if err != nil {
+				return errors.Wrap(err, "reader.Next")
+			}
+			if x == nil {
+				break
+			}
+			if to > 0 {
+				offset, _ := strconv.ParseInt(x[":offset"], 10, 64)
+				if offset >= to {
+					break
+				}
+			}
+			if !xlogtools.ValidXlog(x) {
+				log.Printf("DryRun: %s offset=%s skipping bad xlog: %#v\n",
+					reader.Filename, x[":offset"], x)
+				continue
+			}
+			if err = ReaderNormalizedLog(reader, l.LogNorm, x); err != nil {
+				return err
+			}
+
+			baseTable := x["base_table"]
+			tk, ok := baseTableKeys[baseTable]
+			if !ok {
+				tk.keys, tk.columns = l.dryRunKeys(baseTable)
+				baseTableKeys[baseTable] = tk
+			}
+			if len(row) < len(tk.keys) {
+				row = make([]interface{}, len(tk.keys))
+			}
+			loadXlogRow(row, tk.keys, l.tableInsertDefaults[baseTable], x)
+			if err = out.WriteRow(x["table"], tk.columns, row[:len(tk.keys)]); err != nil {
+				return err
+			}
+			l.RowCount++
+		}
+	}
+	log.Printf("DryRun: wrote %d rows\n", l.RowCount)
+	return out.Flush()
+}
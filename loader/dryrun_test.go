@@ -0,0 +1,45 @@
+package loader
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRowWriter(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"jsonl", `{"table":"logrecord","values":{"name":"Inkie","xl":"3"}}
+{"table":"logrecord","values":{"name":"hugeterm","xl":"27"}}
+{"table":"milestone","values":{"name":"Inkie"}}
+`},
+		{"csv", `table,name,xl
+logrecord,Inkie,3
+logrecord,hugeterm,27
+table,name
+milestone,Inkie
+`},
+	}
+	for _, test := range tests {
+		buf := bytes.Buffer{}
+		w, err := NewRowWriter(test.format, &buf)
+		if err != nil {
+			t.Errorf("NewRowWriter(%#v) failed: %s", test.format, err)
+			continue
+		}
+		w.WriteRow("logrecord", []string{"name", "xl"}, []interface{}{"Inkie", "3"})
+		w.WriteRow("logrecord", []string{"name", "xl"}, []interface{}{"hugeterm", "27"})
+		w.WriteRow("milestone", []string{"name"}, []interface{}{"Inkie"})
+		if err = w.Flush(); err != nil {
+			t.Errorf("%s Flush() failed: %s", test.format, err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("%s rows:\n%s\nexpected:\n%s", test.format, buf.String(), test.expected)
+		}
+	}
+
+	if _, err := NewRowWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Errorf("NewRowWriter(xml) succeeded, expected error")
+	}
+}
@@ -2,17 +2,21 @@ package loader
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
-	"io"
 	"log"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/crawl/go-sequell/crawl/db"
 	"github.com/crawl/go-sequell/crawl/xlogtools"
 	"github.com/crawl/go-sequell/pg"
 	"github.com/crawl/go-sequell/sources"
+	"github.com/crawl/go-sequell/text"
 	"github.com/crawl/go-sequell/xlog"
 	"github.com/lib/pq"
 	"github.com/pkg/errors"
@@ -20,6 +24,10 @@ import (
 
 const loadBufferSize = 50000
 
+// copyCancelCheckInterval is the number of rows copied into a table between
+// checks for cancellation.
+const copyCancelCheckInterval = 1000
+
 var (
 	// ErrDuplicateRow means the loader found an xlogfile row exactly identical
 	// to a previously inserted row
@@ -38,6 +46,31 @@ type Loader struct {
 	RowCount         int64
 	LogNorm          *xlogtools.Normalizer
 
+	// Concurrency is the number of workers that load logs in parallel in
+	// LoadCommit. Each worker loads a subset of the readers using its own
+	// transactions and lookup caches. Values less than 2 load serially.
+	Concurrency int
+
+	// OnRewrite is the policy applied to files that no longer match the
+	// offset and checksum recorded in the database.
+	OnRewrite RewritePolicy
+
+	// keepFileOffsets is set when loading lines out of order, such as
+	// retried rejects, which must not change the offsets in l_file.
+	keepFileOffsets bool
+
+	// fileSources maps the db filenames of logs added to the loader to
+	// their sources, which are recorded in l_file.
+	fileSources map[string]*sources.XlogSrc
+
+	// tx, if set, is the transaction used for all of the loader's reads
+	// and writes, which are committed or rolled back by tx's owner.
+	tx *sql.Tx
+
+	// pendingRejects are the lines rejected by readers of each table since
+	// the last commit.
+	pendingRejects map[string][]*Reject
+
 	tableLookups        map[string][]*TableLookup
 	tableInsertFields   map[string][]*db.Field
 	tableInsertKeys     map[string][]string
@@ -78,24 +111,38 @@ func (l *Loader) init() {
 	xlogs := l.Servers.XlogSources()
 	l.Readers = make([]*Reader, len(xlogs))
 	for i, x := range xlogs {
-		l.Readers[i] = &Reader{
-			Reader:  xlog.NewReader(x.Server.Name, x.TargetPath, x.TargetRelPath),
-			XlogSrc: x,
-			Table:   l.TableName(x),
-		}
+		l.Readers[i] = l.newReader(x)
 	}
 	l.createTableLookups()
 	l.initTableInsertFields()
 	l.initCopyStatements()
-	l.offsetQuery = l.createOffsetQueryStmt()
 }
 
-func (l *Loader) createOffsetQueryStmt() *sql.Stmt {
-	stmt, err := l.DB.Prepare("select file_offset from l_file where file = $1")
-	if err != nil {
-		panic(err)
+// offsetStmt returns the prepared query for file offsets and checksums,
+// preparing it on first use.
+func (l *Loader) offsetStmt(ctx context.Context) (*sql.Stmt, error) {
+	if l.offsetQuery == nil {
+		stmt, err := l.DB.PrepareContext(ctx,
+			"select file_offset, file_checksum from l_file where file = $1")
+		if err != nil {
+			return nil, schemaError(err, "prepare l_file offset query")
+		}
+		l.offsetQuery = stmt
 	}
-	return stmt
+	return l.offsetQuery, nil
+}
+
+// schemaError wraps err with context, explaining errors caused by tables or
+// columns missing from a db whose schema has not been upgraded.
+func schemaError(err error, context string) error {
+	if pqErr, ok := errors.Cause(err).(*pq.Error); ok {
+		switch pqErr.Code {
+		case "42P01", "42703": // undefined_table, undefined_column
+			return fmt.Errorf("%s: %s: the db schema is out of date; run seqdb migrate up",
+				context, pqErr.Message)
+		}
+	}
+	return errors.Wrap(err, context)
 }
 
 func (l *Loader) createTableLookups() {
@@ -125,9 +172,41 @@ func (l *Loader) createTableLookups() {
 				}
 			}
 		}
+		// All tables resolve lookups in the same order so that concurrent
+		// loaders lock lookup table rows in the same order.
+		sort.Sort(tableLookupSort(l.tableLookups[tableName]))
 	}
 }
 
+type tableLookupSort []*TableLookup
+
+func (t tableLookupSort) Len() int           { return len(t) }
+func (t tableLookupSort) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t tableLookupSort) Less(i, j int) bool { return t[i].Name() < t[j].Name() }
+
+// worker creates a loader that shares l's configuration and database
+// connection, but has its own xlog buffer and lookup caches. A worker loads
+// only the readers it is given, and has no readers of its own.
+func (l *Loader) worker() *Loader {
+	w := &Loader{
+		Servers:             l.Servers,
+		DB:                  l.DB,
+		Schema:              l.Schema,
+		Readers:             []*Reader{},
+		gameTypePrefixes:    l.gameTypePrefixes,
+		LogNorm:             l.LogNorm,
+		OnRewrite:           l.OnRewrite,
+		tableInsertFields:   l.tableInsertFields,
+		tableInsertKeys:     l.tableInsertKeys,
+		tableInsertDefaults: l.tableInsertDefaults,
+		tableCopyStatements: l.tableCopyStatements,
+		buffer:              NewBuffer(loadBufferSize),
+		offsetQuery:         l.offsetQuery,
+	}
+	w.createTableLookups()
+	return w
+}
+
 func (l *Loader) initTableInsertFields() {
 	l.tableInsertFields = make(map[string][]*db.Field, len(l.Schema.Tables))
 	l.tableInsertKeys = make(map[string][]string, len(l.Schema.Tables))
@@ -183,30 +262,61 @@ func (l *Loader) FindReader(file string) *Reader {
 	return nil
 }
 
+func (l *Loader) newReader(x *sources.XlogSrc) *Reader {
+	return &Reader{
+		Reader:  xlog.NewReader(x.Server.Name, x.TargetPath, x.TargetRelPath),
+		XlogSrc: x,
+		Table:   l.TableName(x),
+	}
+}
+
+// AddReader adds a reader for the xlog source x, replacing any existing
+// reader for x's target path. The new reader's logs are not loaded until
+// the next Load or LoadLog.
+func (l *Loader) AddReader(x *sources.XlogSrc) *Reader {
+	l.RemoveReader(x.TargetPath)
+	reader := l.newReader(x)
+	l.Readers = append(l.Readers, reader)
+	return reader
+}
+
+// RemoveReader closes and removes the reader for file, returning false if
+// there is no reader for file. Rows already loaded from file are kept.
+func (l *Loader) RemoveReader(file string) bool {
+	for i, r := range l.Readers {
+		if r.TargetPath == file {
+			r.Close()
+			l.Readers = append(l.Readers[:i], l.Readers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // LoadLog loads outstanding logs in the given file.
-func (l *Loader) LoadLog(file string) error {
+func (l *Loader) LoadLog(ctx context.Context, file string) error {
 	reader := l.FindReader(file)
 	if reader == nil {
 		return fmt.Errorf("No reader known for %s", file)
 	}
-	return l.LoadReaderLogs(reader)
+	return l.LoadReaderLogs(ctx, reader)
 }
 
 // LoadCommitLog loads a single log and commits all records to the db.
-func (l *Loader) LoadCommitLog(file string) error {
-	if err := l.LoadLog(file); err != nil {
+func (l *Loader) LoadCommitLog(ctx context.Context, file string) error {
+	if err := l.LoadLog(ctx, file); err != nil {
 		return err
 	}
-	return l.Commit()
+	return l.Commit(ctx)
 }
 
 // Load loads all outstanding logs from all readers, but does not Commit() them
 // automatically. After loading logs, Load closes all file handles.
-func (l *Loader) Load() error {
+func (l *Loader) Load(ctx context.Context) error {
 	l.RowCount = 0
 	for _, r := range l.Readers {
 		defer r.Close()
-		if err := l.LoadReaderLogs(r); err != nil {
+		if err := l.LoadReaderLogs(ctx, r); err != nil {
 			return err
 		}
 	}
@@ -214,38 +324,119 @@ func (l *Loader) Load() error {
 }
 
 // LoadCommit loads all outstanding logs and flushes them to the database. All
-// file handles will be closed at the end of this.
-func (l *Loader) LoadCommit() error {
-	if err := l.Load(); err != nil {
+// file handles will be closed at the end of this. If l.Concurrency > 1, logs
+// are loaded by that many workers in parallel.
+//
+// If ctx is cancelled, the open transaction is rolled back and buffered logs
+// are discarded. Each file's offset in l_file is committed in the same
+// transaction as its rows, so the discarded logs are loaded again by the
+// next load.
+func (l *Loader) LoadCommit(ctx context.Context) error {
+	if l.Concurrency > 1 {
+		return l.loadCommitConcurrent(ctx, l.Concurrency)
+	}
+	if err := l.Load(ctx); err != nil {
 		return errors.Wrap(err, "Loader.Load")
 	}
-	return l.Commit()
+	return l.Commit(ctx)
+}
+
+// loadCommitConcurrent loads all outstanding logs using nworkers parallel
+// workers. Each reader is loaded by exactly one worker, so file offsets are
+// only ever updated by the worker that owns the file. If any worker fails, no
+// further readers are handed out, and the first error is returned once all
+// workers have committed the logs they've already read.
+func (l *Loader) loadCommitConcurrent(ctx context.Context, nworkers int) error {
+	l.RowCount = 0
+	defer l.Close()
+
+	// Workers share the parent's offset query.
+	if _, err := l.offsetStmt(ctx); err != nil {
+		return err
+	}
+
+	readers := make(chan *Reader)
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	workers := make([]*Loader, nworkers)
+	var workerWaitGroup sync.WaitGroup
+	for i := range workers {
+		workers[i] = l.worker()
+		workerWaitGroup.Add(1)
+		go func(w *Loader) {
+			defer workerWaitGroup.Done()
+			for r := range readers {
+				if err := w.LoadReaderLogs(ctx, r); err != nil {
+					fail(errors.Wrap(err, "Loader.LoadReaderLogs"))
+					break
+				}
+			}
+			if err := w.Commit(ctx); err != nil {
+				fail(err)
+			}
+		}(workers[i])
+	}
+
+feedLoop:
+	for _, r := range l.Readers {
+		select {
+		case readers <- r:
+		case <-failed:
+			break feedLoop
+		case <-ctx.Done():
+			fail(ctx.Err())
+			break feedLoop
+		}
+	}
+	close(readers)
+	workerWaitGroup.Wait()
+
+	for _, w := range workers {
+		l.RowCount += w.RowCount
+	}
+	log.Printf("Loaded %d rows using %d workers\n", l.RowCount, nworkers)
+	return firstErr
 }
 
 // LoadReaderLogs loads logs from a single Reader. The Reader will
-// remain open at the end of this call.
-func (l *Loader) LoadReaderLogs(reader *Reader) error {
-	seekPos, err := l.QuerySeekOffset(reader.Filename, reader.Table)
+// remain open at the end of this call. LoadReaderLogs stops with ctx's
+// error if ctx is cancelled.
+func (l *Loader) LoadReaderLogs(ctx context.Context, reader *Reader) error {
+	seekPos, checksum, err := l.querySeekPosition(ctx, reader.Filename)
 	if err != nil {
 		return errors.Wrap(err, "QuerySeekOffset")
 	}
 	if seekPos != -1 {
-		if err = reader.SeekNext(seekPos); err != nil {
+		if err = reader.SeekNextChecksum(seekPos, checksum); err != nil {
 			if err == xlog.ErrNoFile {
 				log.Printf("Ignoring missing file: %s\n", reader.Filename)
 				return nil
 			}
-			var help string
-			if err == io.EOF {
-				help = " (did the file shrink?)"
+			if err != xlog.ErrRewritten {
+				return errors.Wrapf(err, "SeekNext:%s:%d", reader.Filename, seekPos)
 			}
-			return errors.Wrapf(err, "SeekNext:%s:%d%s", reader.Filename, seekPos, help)
+			return l.handleRewrite(ctx, reader, seekPos)
 		}
 	}
 
 	first := true
 	offset := reader.Offset
+	reader.OnMalformed = func(offset int64, line string, err error) {
+		l.recordReject(reader, offset, line, err.Error())
+	}
+	defer func() { reader.OnMalformed = nil }()
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		xlogEntry, err := reader.Next()
 		if err == xlog.ErrNoFile {
 			log.Printf("Ignoring missing file: %s\n", reader.Filename)
@@ -264,9 +455,11 @@ func (l *Loader) LoadReaderLogs(reader *Reader) error {
 		if !xlogtools.ValidXlog(xlogEntry) {
 			log.Printf("LoadLogs: %s offset=%s skipping bad xlog: %#v\n",
 				reader.Filename, xlogEntry[":offset"], xlogEntry)
+			lineOffset, _ := strconv.ParseInt(xlogEntry[":offset"], 10, 64)
+			l.recordReject(reader, lineOffset, reader.LastLine, reasonInvalidXlog)
 			continue
 		}
-		if err = l.Add(reader, xlogEntry); err != nil {
+		if err = l.Add(ctx, reader, xlogEntry); err != nil {
 			return err
 		}
 	}
@@ -274,19 +467,28 @@ func (l *Loader) LoadReaderLogs(reader *Reader) error {
 
 // Add normalizes the xlog and adds it to the buffer of xlogs to be
 // saved to the database.
-func (l *Loader) Add(reader *Reader, x xlog.Xlog) error {
+func (l *Loader) Add(ctx context.Context, reader *Reader, x xlog.Xlog) error {
 	if err := ReaderNormalizedLog(reader, l.LogNorm, x); err != nil {
 		return err
 	}
+	l.noteFileSource(reader)
+
+	return l.addNormalizedLog(ctx, x)
+}
 
-	return l.addNormalizedLog(x)
+// noteFileSource remembers reader's source, to be saved with its offset.
+func (l *Loader) noteFileSource(reader *Reader) {
+	if l.fileSources == nil {
+		l.fileSources = map[string]*sources.XlogSrc{}
+	}
+	l.fileSources[reader.Filename] = reader.XlogSrc
 }
 
 // addNormalizedLog adds a normalized xlog x to the buffer, committing the
 // buffer to the DB if full.
-func (l *Loader) addNormalizedLog(x xlog.Xlog) error {
+func (l *Loader) addNormalizedLog(ctx context.Context, x xlog.Xlog) error {
 	if l.buffer.IsFull() {
-		if err := l.Commit(); err != nil {
+		if err := l.Commit(ctx); err != nil {
 			return err
 		}
 	}
@@ -294,18 +496,25 @@ func (l *Loader) addNormalizedLog(x xlog.Xlog) error {
 	return nil
 }
 
-// Commit saves all buffered xlogs to the database and clears the buffer.
-func (l *Loader) Commit() error {
-	if err := l.saveBufferedLogs(); err != nil {
+// Commit saves all buffered xlogs and rejected lines to the database and
+// clears the buffer. Rejected lines that could not be saved are discarded,
+// and reported again when their readers next read them.
+func (l *Loader) Commit(ctx context.Context) error {
+	err := l.saveBufferedLogs(ctx)
+	if err == nil {
+		err = l.saveAllRejects(ctx)
+	}
+	if err != nil {
+		l.discardRejects()
 		return err
 	}
 	l.buffer.Clear()
 	return nil
 }
 
-func (l *Loader) saveBufferedLogs() error {
+func (l *Loader) saveBufferedLogs(ctx context.Context) error {
 	for table, xlogs := range l.buffer.Buffer {
-		if err := l.loadTableLogs(table, xlogs); err != nil {
+		if err := l.loadTableLogs(ctx, table, xlogs); err != nil {
 			return err
 		}
 	}
@@ -315,8 +524,8 @@ func (l *Loader) saveBufferedLogs() error {
 // loadTableLogs loads the given logs into the target table (such as
 // "logrecord" or "milestone"), inserting reference rows into lookup tables
 // (such as "l_god"), with all inserts performed in a single database
-// transaction.
-func (l *Loader) loadTableLogs(table string, logs []xlog.Xlog) error {
+// transaction. If ctx is cancelled, the transaction is rolled back.
+func (l *Loader) loadTableLogs(ctx context.Context, table string, logs []xlog.Xlog) error {
 	nlogs := len(logs)
 	if nlogs == 0 {
 		return nil
@@ -324,12 +533,13 @@ func (l *Loader) loadTableLogs(table string, logs []xlog.Xlog) error {
 
 	lookups := l.tableLookups[logs[0]["base_table"]]
 
-	tx, err := l.DB.Begin()
+	start := time.Now()
+	tx, err := l.beginTx(ctx)
 	if err != nil {
 		return errors.Wrapf(err, "loadTableLogs(%#v, ...)", table)
 	}
 	fail := func(err error) error {
-		tx.Rollback()
+		l.rollbackTx(tx)
 		return err
 	}
 
@@ -338,28 +548,59 @@ func (l *Loader) loadTableLogs(table string, logs []xlog.Xlog) error {
 		return fail(errors.Wrap(err, "resolvelookups"))
 	}
 
-	if err = l.insertTableLogs(tx, table, deduplicatedLogs); err != nil {
+	if err = l.insertTableLogs(ctx, tx, table, deduplicatedLogs); err != nil {
 		return fail(errors.Wrap(err, "insertTableLogs"))
 	}
 
 	deduplicatedLogCount := len(deduplicatedLogs)
 	if deduplicatedLogCount < nlogs {
 		log.Printf("%s: Skipped %d/%d duplicate rows", table, nlogs-deduplicatedLogCount, nlogs)
+		metricDuplicateRows.Add(float64(nlogs-deduplicatedLogCount), table)
 	}
 
-	if deduplicatedLogCount == 0 {
-		tx.Rollback()
+	rejects := l.pendingRejects[table]
+	if deduplicatedLogCount == 0 && len(rejects) == 0 {
+		l.rollbackTx(tx)
 		return nil
 	}
+	if err = saveRejects(ctx, tx, rejects); err != nil {
+		return fail(err)
+	}
 
-	if err := tx.Commit(); err != nil {
+	if err := l.commitTx(tx); err != nil {
 		return errors.Wrap(err, "loadTableLogs.Commit")
 	}
+	l.savedRejects(table)
+	metricCommitDuration.Observe(time.Since(start).Seconds(), table)
+	metricRowsCommitted.Add(float64(deduplicatedLogCount), table)
 	l.RowCount += int64(deduplicatedLogCount)
 	log.Printf("%s: Committed %d (total: %d)\n", table, deduplicatedLogCount, l.RowCount)
 	return nil
 }
 
+// beginTx begins a transaction, or returns l.tx if set.
+func (l *Loader) beginTx(ctx context.Context) (*sql.Tx, error) {
+	if l.tx != nil {
+		return l.tx, nil
+	}
+	return l.DB.BeginTx(ctx, nil)
+}
+
+// commitTx commits tx, unless it is l.tx.
+func (l *Loader) commitTx(tx *sql.Tx) error {
+	if tx == l.tx {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// rollbackTx rolls back tx, unless it is l.tx.
+func (l *Loader) rollbackTx(tx *sql.Tx) {
+	if tx != l.tx {
+		tx.Rollback()
+	}
+}
+
 // resolveLookupFieldIds deduplicates the given logs and resolves foreign-key
 // references in the given set of xlogs, where all xlogs are for a single
 // destinationTable (such as "logrecord")
@@ -427,7 +668,7 @@ func (l *Loader) applyLookups(lookups []*TableLookup, logs []xlog.Xlog) (dedupli
 	return removeXlogLinesAtIndexes(logs, duplicateIndexes), nil
 }
 
-func (l *Loader) insertTableLogs(tx *sql.Tx, table string, logs []xlog.Xlog) error {
+func (l *Loader) insertTableLogs(ctx context.Context, tx *sql.Tx, table string, logs []xlog.Xlog) error {
 	if len(logs) == 0 {
 		return nil
 	}
@@ -435,23 +676,34 @@ func (l *Loader) insertTableLogs(tx *sql.Tx, table string, logs []xlog.Xlog) err
 	baseTable := logs[0]["base_table"]
 	keys := l.tableInsertKeys[baseTable]
 	defaults := l.tableInsertDefaults[baseTable]
-	st, err := tx.Prepare(l.tableCopyStatements[table])
+	st, err := tx.PrepareContext(ctx, l.tableCopyStatements[table])
 	if err != nil {
 		return errors.Wrap(err, "Loader.insertTableLogs.Prepare")
 	}
 
 	row := make([]interface{}, len(keys))
-	fileOffsets := map[string]string{}
+	fileOffsets := map[string]*fileOffset{}
 
-	for _, x := range logs {
+	for i, x := range logs {
+		if i%copyCancelCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				st.Close()
+				return err
+			}
+		}
 		loadXlogRow(row, keys, defaults, x)
 		if _, err := st.Exec(row...); err != nil {
 			return errors.Wrapf(err, "Loader.insertTableLogs.Exec(%#v)", x)
 		}
-		fileOffsets[x["file"]] = x["offset"]
+		fo := fileOffsets[x["file"]]
+		if fo == nil {
+			fo = &fileOffset{}
+			fileOffsets[x["file"]] = fo
+		}
+		fo.add(x)
 	}
 
-	if _, err = st.Exec(); err != nil {
+	if _, err = st.ExecContext(ctx); err != nil {
 		return errors.Wrap(err, "Loader.insertTableLogs.Exec()")
 	}
 
@@ -459,53 +711,106 @@ func (l *Loader) insertTableLogs(tx *sql.Tx, table string, logs []xlog.Xlog) err
 		return errors.Wrap(err, "Loader.insertTableLogs.Close()")
 	}
 
-	if err = l.updateFileOffsets(tx, fileOffsets); err != nil {
+	if err = l.updateFileOffsets(ctx, tx, fileOffsets); err != nil {
 		return errors.Wrap(err, "Loader.updateFileOffsets")
 	}
 
 	return nil
 }
 
-func (l *Loader) updateFileOffsets(tx *sql.Tx, offsets map[string]string) error {
+// A fileOffset is the offset and checksum of the last line loaded from a
+// file, with the number and time range of the rows loaded.
+type fileOffset struct {
+	offset    string
+	checksum  string
+	rows      int64
+	firstTime string
+	lastTime  string
+}
+
+// add records the loaded row x in f. Rows are loaded in file order, but the
+// row times are compared in case a file's rows are out of order.
+func (f *fileOffset) add(x xlog.Xlog) {
+	f.offset, f.checksum = x["offset"], x["checksum"]
+	f.rows++
+	rowTime := text.FirstNotEmpty(x["end"], x["time"])
+	if rowTime == "" {
+		return
+	}
+	if f.firstTime == "" || rowTime < f.firstTime {
+		f.firstTime = rowTime
+	}
+	if rowTime > f.lastTime {
+		f.lastTime = rowTime
+	}
+}
+
+// fileOffsetColumns are the values bound for each file by updateFileOffsets.
+const fileOffsetColumns = 10
+
+func (l *Loader) updateFileOffsets(ctx context.Context, tx *sql.Tx, offsets map[string]*fileOffset) error {
 	noffsets := len(offsets)
 	if noffsets == 0 {
 		return nil
 	}
 	sql := l.updateFileOffsetSQL(noffsets)
-	values := make([]interface{}, noffsets*2)
-	i := 0
-	for file, offsetText := range offsets {
-		values[i] = NormalizeValue(file)
-		offset, err := strconv.ParseInt(offsetText, 10, 64)
+	values := make([]interface{}, 0, noffsets*fileOffsetColumns)
+	nullable := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	for file, fileOffset := range offsets {
+		offset, err := strconv.ParseInt(fileOffset.offset, 10, 64)
 		if err != nil {
 			return err
 		}
-		values[i+1] = offset
-		i += 2
+		var server, url, game, xlogType interface{}
+		if src := l.fileSources[file]; src != nil {
+			server, url, game, xlogType = src.Server.Name, src.URL, src.Game, src.Type.String()
+		}
+		values = append(values, NormalizeValue(file), offset, fileOffset.checksum,
+			fileOffset.rows, nullable(fileOffset.firstTime), nullable(fileOffset.lastTime),
+			server, url, game, xlogType)
 	}
-	_, err := tx.Exec(sql, values...)
+	_, err := tx.ExecContext(ctx, sql, values...)
 	return err
 }
 
+// updateFileOffsetSQL builds the statement that updates noffset files in
+// l_file. If the loader keeps file offsets, only the rows, row times and
+// sources of the files are updated.
 func (l *Loader) updateFileOffsetSQL(noffset int) string {
 	var buf bytes.Buffer
-	buf.WriteString(`update l_file f set file_offset = c.file_offset
-							  from (values `)
-	index := 0
+	buf.WriteString(`update l_file f set `)
+	if !l.keepFileOffsets {
+		buf.WriteString(`file_offset = c.file_offset,
+						 file_checksum = c.file_checksum, `)
+	}
+	buf.WriteString(`file_rows = coalesce(f.file_rows, 0) + c.file_rows,
+					 file_first_time = least(f.file_first_time, c.first_time),
+					 file_last_time = greatest(f.file_last_time, c.last_time),
+					 file_loaded_at = now(),
+					 file_server = coalesce(c.server, f.file_server),
+					 file_url = coalesce(c.url, f.file_url),
+					 file_game = coalesce(c.game, f.file_game),
+					 file_xlog_type = coalesce(c.xlog_type, f.file_xlog_type)
+				from (values `)
+	binder := pg.NewBinder()
 	for i := 0; i < noffset; i++ {
 		if i > 0 {
 			buf.WriteString(", ")
 		}
-		buf.WriteString("($")
-		buf.WriteString(strconv.Itoa(index + 1))
-		index++
-		buf.WriteString(", $")
-		buf.WriteString(strconv.Itoa(index + 1))
-		buf.WriteString("::bigint")
-		index++
-		buf.WriteString(")")
-	}
-	buf.WriteString(`) as c (file, file_offset) where f.file = c.file`)
+		buf.WriteString("(" + binder.Next() + ", " + binder.Next() + "::bigint, " +
+			binder.Next() + ", " + binder.Next() + "::bigint, " +
+			binder.Next() + "::timestamp, " + binder.Next() + "::timestamp, " +
+			binder.Next() + ", " + binder.Next() + ", " + binder.Next() + ", " +
+			binder.Next() + ")")
+	}
+	buf.WriteString(`) as c (file, file_offset, file_checksum, file_rows,
+						   first_time, last_time, server, url, game, xlog_type)
+			  where f.file = c.file`)
 	return buf.String()
 }
 
@@ -528,17 +833,34 @@ func loadXlogRow(row []interface{}, keys []string, defaults []string, x xlog.Xlo
 // QuerySeekOffset checks the last read offset of the file as saved in
 // the table, or -1 if the file is not referenced in the table.
 func (l *Loader) QuerySeekOffset(file, table string) (int64, error) {
+	offset, _, err := l.querySeekPosition(context.Background(), file)
+	return offset, err
+}
+
+// querySeekPosition returns the last read offset of the file and the checksum
+// of the line at that offset, or -1 if the file is not referenced in the
+// table. The checksum is empty for files loaded before checksums were
+// recorded.
+func (l *Loader) querySeekPosition(ctx context.Context, file string) (int64, string, error) {
 	var offset sql.NullInt64
-	if err := l.offsetQuery.QueryRow(NormalizeValue(file)).Scan(&offset); err != nil {
+	var checksum sql.NullString
+	offsetQuery, err := l.offsetStmt(ctx)
+	if err != nil {
+		return -1, "", err
+	}
+	if l.tx != nil {
+		offsetQuery = l.tx.StmtContext(ctx, offsetQuery)
+	}
+	if err := offsetQuery.QueryRowContext(ctx, NormalizeValue(file)).Scan(&offset, &checksum); err != nil {
 		if err == sql.ErrNoRows {
-			return -1, nil
+			return -1, "", nil
 		}
-		return -1, err
+		return -1, "", err
 	}
 	if offset.Valid {
-		return offset.Int64, nil
+		return offset.Int64, checksum.String, nil
 	}
-	return -1, nil
+	return -1, "", nil
 }
 
 // Close closes the loader and associated resources.
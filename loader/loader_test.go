@@ -1,6 +1,7 @@
 package loader
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -105,7 +106,7 @@ func TestLoader(t *testing.T) {
 	}
 
 	fmt.Println("Loading logs")
-	if err := ldr.LoadCommit(); err != nil {
+	if err := ldr.LoadCommit(context.Background()); err != nil {
 		t.Errorf("Error loading logs: %s\n", err)
 	}
 }
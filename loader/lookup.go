@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -209,11 +210,13 @@ func (t *TableLookup) lookupKey(lookup string) string {
 func (t *TableLookup) AddLookup(lookup string, derivedValues []string) {
 	key := t.lookupKey(lookup)
 	if _, ok := t.idCache.Get(key); ok {
+		metricLookupCacheHits.Inc(t.Name())
 		if t.globallyUnique {
 			t.duplicateGlobalLookupIDs[key] = true
 		}
 		return
 	}
+	metricLookupCacheMisses.Inc(t.Name())
 	if t.IsFull() {
 		panic(fmt.Sprintf("TableLookup[%s] full", t.Table.Name))
 	}
@@ -256,14 +259,32 @@ func (t *TableLookup) insertNewValues(tx *sql.Tx) error {
 	if len(t.Lookups) == 0 {
 		return nil
 	}
+	keys := t.sortedLookupKeys()
 	insertQuery :=
-		t.insertStatement(len(t.Lookups), len(t.derivedFieldNames)+1)
-	values := t.insertValues()
+		t.insertStatement(len(keys), len(t.derivedFieldNames)+1)
+	values := t.insertValues(keys)
 	rows, err := tx.Query(insertQuery, values...)
 	if err != nil {
 		return errors.Wrapf(err, "Query: %s, binds: %#v", insertQuery, values)
 	}
-	return t.resolveRows(rows, fieldValueLookupNew)
+	if err = t.resolveRows(rows, fieldValueLookupNew); err != nil {
+		return err
+	}
+	// Values inserted by a concurrent loader are skipped by the insert's
+	// conflict clause, and must be looked up as existing values.
+	return t.findExistingValueIDs(tx)
+}
+
+// sortedLookupKeys returns the keys of all queued lookups in sorted order.
+// Concurrent loaders insert lookup values in the same order so that they
+// cannot deadlock on each others' inserts.
+func (t *TableLookup) sortedLookupKeys() []string {
+	keys := make([]string, 0, len(t.Lookups))
+	for k := range t.Lookups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func (t *TableLookup) findExistingValueIDs(tx *sql.Tx) error {
@@ -355,14 +376,16 @@ func (t *TableLookup) insertStatement(nrows int, bindsPerRow int) string {
 		}
 		buf.WriteString(")\n")
 	}
+	buf.WriteString("on conflict do nothing\n")
 	buf.WriteString("returning id, " + t.lookupField.SQLName)
 	return buf.String()
 }
 
-func (t *TableLookup) insertValues() []interface{} {
-	res := make([]interface{}, len(t.Lookups)*(1+len(t.derivedFieldNames)))
+func (t *TableLookup) insertValues(keys []string) []interface{} {
+	res := make([]interface{}, len(keys)*(1+len(t.derivedFieldNames)))
 	i := 0
-	for _, v := range t.Lookups {
+	for _, k := range keys {
+		v := t.Lookups[k]
 		res[i] = NormalizeValue(v.Value)
 		i++
 		for _, v := range v.DerivedValues {
@@ -0,0 +1,26 @@
+package loader
+
+import (
+	"github.com/crawl/go-sequell/metrics"
+)
+
+var (
+	metricRowsCommitted = metrics.Default.NewCounter(
+		"sequell_loader_rows_committed_total",
+		"Game and milestone rows committed to the database.", "table")
+	metricDuplicateRows = metrics.Default.NewCounter(
+		"sequell_loader_duplicate_rows_total",
+		"Rows skipped because they were already in the database.", "table")
+	metricBadLines = metrics.Default.NewCounter(
+		"sequell_loader_bad_lines_total",
+		"Malformed or invalid xlog lines skipped.", "table")
+	metricLookupCacheHits = metrics.Default.NewCounter(
+		"sequell_loader_lookup_cache_hits_total",
+		"Lookup values resolved from the loader's id cache.", "lookup")
+	metricLookupCacheMisses = metrics.Default.NewCounter(
+		"sequell_loader_lookup_cache_misses_total",
+		"Lookup values that had to be resolved in the database.", "lookup")
+	metricCommitDuration = metrics.Default.NewSummary(
+		"sequell_loader_commit_duration_seconds",
+		"Time taken to commit batches of rows, including lookups.", "table")
+)
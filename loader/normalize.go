@@ -22,7 +22,9 @@ func ReaderNormalizedLog(reader *Reader, normalizer LogNormalizer, x xlog.Xlog)
 	x["base_table"] = reader.Type.BaseTable()
 	x["src"] = reader.Server.Name
 	x["offset"] = x[":offset"]
+	x["checksum"] = x[":checksum"]
 	delete(x, ":offset")
+	delete(x, ":checksum")
 
 	if version.IsVersionLike(x["explbr"]) {
 		delete(x, "explbr")
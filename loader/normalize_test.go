@@ -39,6 +39,7 @@ func TestReaderNormalizedLog(t *testing.T) {
 		normalizedXlog xlog.Xlog
 	}{
 		{"offset", xlog.Xlog{":offset": "39"}, xlog.Xlog{"offset": "39"}},
+		{"checksum", xlog.Xlog{":checksum": "e5fa"}, xlog.Xlog{"checksum": "e5fa", ":checksum": ""}},
 		{"explbr-version-zap", xlog.Xlog{"explbr": "0.17"}, xlog.Xlog{"explbr": ""}},
 		{"explbr-normal-passthrough", xlog.Xlog{"explbr": "direcows"}, xlog.Xlog{"explbr": "direcows"}},
 	} {
@@ -0,0 +1,241 @@
+package loader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/crawl/go-sequell/crawl/xlogtools"
+	"github.com/crawl/go-sequell/xlog"
+	"github.com/pkg/errors"
+)
+
+// normDiffExamples is the number of example changes kept for each field.
+const normDiffExamples = 3
+
+// normDiffSeed seeds the choice of sampled xlogs, so that repeated runs on
+// the same logs compare the same xlogs.
+const normDiffSeed = 1
+
+// normErrorField is the pseudo-field under which normalization errors are
+// reported, when only one of the normalizers fails.
+const normErrorField = "(error)"
+
+// A NormDiff is the set of field changes between normalizing the same xlogs
+// with two different normalizers.
+type NormDiff struct {
+	// Rows is the number of xlogs compared, and ChangedRows the number that
+	// normalized differently.
+	Rows        int
+	ChangedRows int
+
+	// Fields maps field names to their changes.
+	Fields map[string]*FieldDiff
+}
+
+// A FieldDiff counts the changes to a single field, with a few examples.
+type FieldDiff struct {
+	Field    string
+	Count    int
+	Examples []NormChange
+}
+
+// A NormChange is a field in an xlog line that normalized to Old with the old
+// normalizer, and New with the new normalizer.
+type NormChange struct {
+	File     string
+	Offset   string
+	Old, New string
+}
+
+func newNormDiff() *NormDiff {
+	return &NormDiff{Fields: map[string]*FieldDiff{}}
+}
+
+// add records the changes between oldX and newX, normalized from the line at
+// offset in file.
+func (d *NormDiff) add(file, offset string, oldX, newX xlog.Xlog) {
+	d.Rows++
+	changed := changedFields(oldX, newX)
+	if len(changed) == 0 {
+		return
+	}
+	d.ChangedRows++
+	for _, field := range changed {
+		fd := d.Fields[field]
+		if fd == nil {
+			fd = &FieldDiff{Field: field}
+			d.Fields[field] = fd
+		}
+		fd.Count++
+		if len(fd.Examples) < normDiffExamples {
+			fd.Examples = append(fd.Examples, NormChange{
+				File: file, Offset: offset, Old: oldX[field], New: newX[field],
+			})
+		}
+	}
+}
+
+// changedFields returns the sorted names of fields whose values differ
+// between a and b, including fields present in only one of them.
+func changedFields(a, b xlog.Xlog) []string {
+	changed := []string{}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// SortedFields returns the changed fields, most frequently changed first.
+func (d *NormDiff) SortedFields() []*FieldDiff {
+	fields := make([]*FieldDiff, 0, len(d.Fields))
+	for _, fd := range d.Fields {
+		fields = append(fields, fd)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].Count != fields[j].Count {
+			return fields[i].Count > fields[j].Count
+		}
+		return fields[i].Field < fields[j].Field
+	})
+	return fields
+}
+
+// Write writes a report of the changed fields, with examples, to w.
+func (d *NormDiff) Write(w io.Writer) error {
+	fmt.Fprintf(w, "%d of %d rows changed\n", d.ChangedRows, d.Rows)
+	if d.ChangedRows == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tROWS\tEXAMPLE\tOLD\tNEW")
+	for _, fd := range d.SortedFields() {
+		for i, ex := range fd.Examples {
+			field, count := "", ""
+			if i == 0 {
+				field, count = fd.Field, strconv.Itoa(fd.Count)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s:%s\t%q\t%q\n", field, count,
+				ex.File, ex.Offset, ex.Old, ex.New)
+		}
+	}
+	return tw.Flush()
+}
+
+// normalizeForDiff normalizes a copy of x from reader with norm. If
+// normalization fails, the copy holds only the error, under normErrorField.
+func normalizeForDiff(reader *Reader, norm LogNormalizer, x xlog.Xlog) xlog.Xlog {
+	nx := x.Clone()
+	if err := ReaderNormalizedLog(reader, norm, nx); err != nil {
+		return xlog.Xlog{normErrorField: errors.Cause(err).Error()}
+	}
+	return nx
+}
+
+// NormDiff normalizes the xlogs read by all readers with both oldNorm and
+// newNorm, and returns the fields that normalize differently. If sample is
+// positive, at most sample xlogs are compared from each file, picked at
+// random from the whole file. NormDiff does not use the database; create l
+// with NewDryRun.
+func (l *Loader) NormDiff(ctx context.Context, oldNorm, newNorm LogNormalizer, sample int) (*NormDiff, error) {
+	defer l.Close()
+	diff := newNormDiff()
+	rng := rand.New(rand.NewSource(normDiffSeed))
+	compare := func(reader *Reader, x xlog.Xlog) {
+		diff.add(reader.Filename, x[":offset"],
+			normalizeForDiff(reader, oldNorm, x),
+			normalizeForDiff(reader, newNorm, x))
+	}
+	for _, reader := range l.Readers {
+		var sampled *xlogSample
+		if sample > 0 {
+			sampled = newXlogSample(sample, rng)
+		}
+		for {
+			if err := ctx.Err(); err != nil {
+				return diff, err
+			}
+			x, err := reader.Next()
+			if err == xlog.ErrNoFile {
+				log.Printf("Ignoring missing file: %s\n", reader.Filename)
+				break
+			}
+			if err != nil {
+				return diff, errors.Wrap(err, "reader.Next")
+			}
+			if x == nil {
+				break
+			}
+			if !xlogtools.ValidXlog(x) {
+				continue
+			}
+			if sampled != nil {
+				sampled.add(x)
+			} else {
+				compare(reader, x)
+			}
+		}
+		if sampled != nil {
+			for _, x := range sampled.xlogs() {
+				compare(reader, x)
+			}
+		}
+	}
+	return diff, nil
+}
+
+// An xlogSample is a uniform random sample of at most size xlogs from a
+// stream of xlogs, chosen by reservoir sampling.
+type xlogSample struct {
+	size int
+	seen int
+	rng  *rand.Rand
+	kept []sampledXlog
+}
+
+// A sampledXlog is an xlog kept in a sample, with its position in the
+// stream.
+type sampledXlog struct {
+	index int
+	x     xlog.Xlog
+}
+
+func newXlogSample(size int, rng *rand.Rand) *xlogSample {
+	return &xlogSample{size: size, rng: rng}
+}
+
+// add offers x to the sample, keeping it with probability size/seen.
+func (s *xlogSample) add(x xlog.Xlog) {
+	s.seen++
+	if len(s.kept) < s.size {
+		s.kept = append(s.kept, sampledXlog{index: s.seen, x: x})
+		return
+	}
+	if i := s.rng.Intn(s.seen); i < s.size {
+		s.kept[i] = sampledXlog{index: s.seen, x: x}
+	}
+}
+
+// xlogs returns the sampled xlogs, in the order they were added.
+func (s *xlogSample) xlogs() []xlog.Xlog {
+	sort.Slice(s.kept, func(i, j int) bool { return s.kept[i].index < s.kept[j].index })
+	res := make([]xlog.Xlog, len(s.kept))
+	for i, k := range s.kept {
+		res[i] = k.x
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package loader
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/crawl/go-sequell/xlog"
+)
+
+func TestNormDiffAdd(t *testing.T) {
+	diff := newNormDiff()
+	diff.add("cao/logfile", "0",
+		xlog.Xlog{"god": "the Shining One", "place": "D:3", "name": "Inkie"},
+		xlog.Xlog{"god": "The Shining One", "place": "D:3", "name": "Inkie"})
+	diff.add("cao/logfile", "120",
+		xlog.Xlog{"god": "Okawaru", "place": "Vault:1", "name": "Inkie"},
+		xlog.Xlog{"god": "Okawaru", "place": "Vaults:1", "name": "Inkie", "br": "Vaults"})
+	diff.add("cao/logfile", "240",
+		xlog.Xlog{"god": "the Shining One", "name": "hugeterm"},
+		xlog.Xlog{"god": "The Shining One", "name": "hugeterm"})
+	diff.add("cao/logfile", "360",
+		xlog.Xlog{"name": "hugeterm"},
+		xlog.Xlog{"name": "hugeterm"})
+
+	if diff.Rows != 4 || diff.ChangedRows != 3 {
+		t.Errorf("%d of %d rows changed, expected 3 of 4", diff.ChangedRows, diff.Rows)
+	}
+
+	fields := []string{}
+	counts := []int{}
+	for _, fd := range diff.SortedFields() {
+		fields = append(fields, fd.Field)
+		counts = append(counts, fd.Count)
+	}
+	if expected := []string{"god", "br", "place"}; !reflect.DeepEqual(fields, expected) {
+		t.Errorf("changed fields %#v, expected %#v", fields, expected)
+	}
+	if expected := []int{2, 1, 1}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("change counts %#v, expected %#v", counts, expected)
+	}
+
+	example := diff.Fields["place"].Examples[0]
+	if expected := (NormChange{File: "cao/logfile", Offset: "120", Old: "Vault:1", New: "Vaults:1"}); example != expected {
+		t.Errorf("place example %#v, expected %#v", example, expected)
+	}
+}
+
+func TestXlogSample(t *testing.T) {
+	s := newXlogSample(10, rand.New(rand.NewSource(normDiffSeed)))
+	for i := 0; i < 1000; i++ {
+		s.add(xlog.Xlog{":offset": strconv.Itoa(i)})
+	}
+	sampled := s.xlogs()
+	if len(sampled) != 10 {
+		t.Fatalf("sampled %d xlogs, expected 10", len(sampled))
+	}
+	last := -1
+	for _, x := range sampled {
+		offset, _ := strconv.Atoi(x[":offset"])
+		if offset <= last {
+			t.Errorf("sampled offset %d after %d, expected increasing offsets", offset, last)
+		}
+		last = offset
+	}
+	if last < 10 {
+		t.Errorf("sampled only the first xlogs: last offset %d", last)
+	}
+
+	s = newXlogSample(10, rand.New(rand.NewSource(normDiffSeed)))
+	for i := 0; i < 3; i++ {
+		s.add(xlog.Xlog{":offset": strconv.Itoa(i)})
+	}
+	if n := len(s.xlogs()); n != 3 {
+		t.Errorf("sampled %d of 3 xlogs, expected all 3", n)
+	}
+}
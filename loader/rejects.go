@@ -0,0 +1,229 @@
+package loader
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/crawl/xlogtools"
+	"github.com/crawl/go-sequell/pg"
+	"github.com/crawl/go-sequell/xlog"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// RejectsTable is the table that records xlog lines that could not be
+// loaded, so that they can be counted and loaded again once the parser or
+// normalizer is fixed.
+const RejectsTable = db.RejectsTable
+
+// reasonInvalidXlog is the reject reason for lines that parse, but are not
+// valid games or milestones.
+const reasonInvalidXlog = "invalid xlog: needs name, start, and end or time"
+
+// A Reject is an xlog line that could not be loaded.
+type Reject struct {
+	ID         int64
+	File       string
+	Src        string
+	Table      string
+	Offset     int64
+	Line       string
+	Reason     string
+	RejectedAt time.Time
+
+	// reader is the reader that rejected the line, for rejects not yet
+	// saved.
+	reader *Reader
+}
+
+// recordReject records a line from reader that could not be loaded. Rejects
+// are saved with the next commit, in the transaction that saves the rows
+// (and offsets) of their table, so that they are discarded if the rows are.
+func (l *Loader) recordReject(reader *Reader, offset int64, line, reason string) {
+	if l.pendingRejects == nil {
+		l.pendingRejects = map[string][]*Reject{}
+	}
+	l.pendingRejects[reader.Table] = append(l.pendingRejects[reader.Table], &Reject{
+		File:   reader.Filename,
+		Src:    reader.Server.Name,
+		Table:  reader.Table,
+		Offset: offset,
+		Line:   line,
+		Reason: reason,
+		reader: reader,
+	})
+}
+
+// savedRejects clears the rejects pending for table, which have been
+// committed. Retried rejects were counted when first rejected.
+func (l *Loader) savedRejects(table string) {
+	if n := len(l.pendingRejects[table]); n > 0 && !l.keepFileOffsets {
+		metricBadLines.Add(float64(n), table)
+	}
+	delete(l.pendingRejects, table)
+}
+
+// discardRejects discards all pending rejects, which were not saved because
+// their commit failed. Their readers report the rejected lines again when
+// they are next read.
+func (l *Loader) discardRejects() {
+	for table, rejects := range l.pendingRejects {
+		for _, r := range rejects {
+			r.reader.ForgetMalformed(r.Offset)
+		}
+		delete(l.pendingRejects, table)
+	}
+}
+
+// saveRejects saves rejects in tx. A line rejected again replaces its
+// earlier record.
+func saveRejects(ctx context.Context, tx *sql.Tx, rejects []*Reject) error {
+	for _, r := range rejects {
+		if _, err := tx.ExecContext(ctx, `insert into `+RejectsTable+`
+			   (file, src, xlog_table, file_offset, line, reason)
+		values ($1, $2, $3, $4, $5, $6)
+		on conflict (file, file_offset)
+		do update set line = excluded.line, reason = excluded.reason,
+					  rejected_at = now()`,
+			r.File, r.Src, r.Table, r.Offset, r.Line, r.Reason); err != nil {
+			return schemaError(err, "save rejected line "+r.File+":"+strconv.FormatInt(r.Offset, 10))
+		}
+	}
+	return nil
+}
+
+// deleteFileRejects deletes the rejected lines recorded for file in tx.
+func deleteFileRejects(ctx context.Context, tx *sql.Tx, file string) error {
+	_, err := tx.ExecContext(ctx, `delete from `+RejectsTable+` where file = $1`, file)
+	return schemaError(err, "delete rejected lines of "+file)
+}
+
+// saveAllRejects saves the pending rejects of tables that had no rows to
+// commit, in a transaction of their own.
+func (l *Loader) saveAllRejects(ctx context.Context) error {
+	if len(l.pendingRejects) == 0 {
+		return nil
+	}
+	tx, err := l.beginTx(ctx)
+	if err != nil {
+		return errors.Wrap(err, "saveAllRejects")
+	}
+	for table := range l.pendingRejects {
+		if err = saveRejects(ctx, tx, l.pendingRejects[table]); err != nil {
+			l.rollbackTx(tx)
+			return err
+		}
+	}
+	if err = l.commitTx(tx); err != nil {
+		return errors.Wrap(err, "saveAllRejects.Commit")
+	}
+	for table := range l.pendingRejects {
+		l.savedRejects(table)
+	}
+	return nil
+}
+
+// ListRejects returns the rejected lines from files, or from all files if
+// files is empty, ordered by file and offset. A db without a rejects table
+// has no rejects.
+func ListRejects(ctx context.Context, c pg.DB, files []string) ([]*Reject, error) {
+	exists, err := c.TableExists(RejectsTable)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListRejects")
+	}
+	if !exists {
+		return []*Reject{}, nil
+	}
+	query := `select id, file, src, xlog_table, file_offset, line, reason,
+					 rejected_at
+				from ` + RejectsTable
+	binds := []interface{}{}
+	if len(files) > 0 {
+		query += ` where file = any($1)`
+		binds = append(binds, pq.Array(files))
+	}
+	rows, err := c.QueryContext(ctx, query+` order by file, file_offset`, binds...)
+	if err != nil {
+		return nil, errors.Wrap(err, "ListRejects")
+	}
+	defer rows.Close()
+
+	rejects := []*Reject{}
+	for rows.Next() {
+		var r Reject
+		if err = rows.Scan(&r.ID, &r.File, &r.Src, &r.Table, &r.Offset,
+			&r.Line, &r.Reason, &r.RejectedAt); err != nil {
+			return nil, err
+		}
+		rejects = append(rejects, &r)
+	}
+	return rejects, rows.Err()
+}
+
+// findReaderFilename returns the reader whose db filename is file.
+func (l *Loader) findReaderFilename(file string) *Reader {
+	for _, r := range l.Readers {
+		if r.Filename == file {
+			return r
+		}
+	}
+	return nil
+}
+
+// RetryRejects runs the rejected lines from files (or all files, if files
+// is empty) through the current parser and normalizer, loading the lines
+// that are now accepted and removing them from the rejects table. Lines
+// that are still rejected have their reasons updated. Retried lines do not
+// change the offsets recorded for their files.
+func (l *Loader) RetryRejects(ctx context.Context, files []string) (loaded, rejected int, err error) {
+	rejects, err := ListRejects(ctx, l.DB, files)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	w := l.worker()
+	w.keepFileOffsets = true
+	accepted := []int64{}
+	for _, r := range rejects {
+		reader := l.findReaderFilename(r.File)
+		if reader == nil {
+			log.Printf("Skipping rejected line %s:%d: no source for %s\n", r.File, r.Offset, r.File)
+			rejected++
+			continue
+		}
+		x, err := xlog.Parse(r.Line, reader.SourceKey)
+		if err == nil && !xlogtools.ValidXlog(x) {
+			err = errors.New(reasonInvalidXlog)
+		}
+		if err == nil {
+			x[":offset"] = strconv.FormatInt(r.Offset, 10)
+			x[":checksum"] = xlog.LineChecksum(r.Line)
+			err = ReaderNormalizedLog(reader, w.LogNorm, x)
+		}
+		if err != nil {
+			w.recordReject(reader, r.Offset, r.Line, err.Error())
+			rejected++
+			continue
+		}
+		w.noteFileSource(reader)
+		if err = w.addNormalizedLog(ctx, x); err != nil {
+			return loaded, rejected, err
+		}
+		accepted = append(accepted, r.ID)
+	}
+	if err = w.Commit(ctx); err != nil {
+		return loaded, rejected, err
+	}
+
+	if len(accepted) > 0 {
+		if _, err = l.DB.ExecContext(ctx, `delete from `+RejectsTable+`
+											where id = any($1)`, pq.Array(accepted)); err != nil {
+			return loaded, rejected, errors.Wrap(err, "RetryRejects")
+		}
+	}
+	return len(accepted), rejected, nil
+}
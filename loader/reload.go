@@ -0,0 +1,125 @@
+package loader
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+
+	cdb "github.com/crawl/go-sequell/crawl/db"
+	"github.com/pkg/errors"
+)
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// FileRowCounts returns the number of rows loaded from file into each game
+// and milestone table. Tables with no rows from file are omitted.
+func (l *Loader) FileRowCounts(ctx context.Context, file string) (map[string]int64, error) {
+	return l.fileRowCounts(ctx, l.DB, file)
+}
+
+func (l *Loader) fileRowCounts(ctx context.Context, q rowQueryer, file string) (map[string]int64, error) {
+	fileTable := l.Schema.LookupTable(cdb.FileLookupTable)
+	if fileTable == nil {
+		return nil, fmt.Errorf("schema has no %s lookup table", cdb.FileLookupTable)
+	}
+	counts := map[string]int64{}
+	for _, prefix := range l.Schema.TableVariantPrefixes {
+		for _, table := range l.Schema.Tables {
+			fileField := table.FindField(cdb.FileLookupTable)
+			if fileField == nil {
+				continue
+			}
+			tableName := prefix + table.Name
+			var n int64
+			if err := q.QueryRowContext(ctx, `select count(*) from `+tableName+`
+					 where `+fileField.RefName()+` =
+						   (select id from `+fileTable.TableName()+` where file = $1)`,
+				NormalizeValue(file)).Scan(&n); err != nil {
+				return nil, errors.Wrapf(err, "count %s rows from %s", tableName, file)
+			}
+			if n > 0 {
+				counts[tableName] = n
+			}
+		}
+	}
+	return counts, nil
+}
+
+// ReloadFile deletes the rows and rejected lines loaded from file (a
+// reader's db filename), resets its offset, and loads the file again from
+// the start with l's normalizer. The delete and the reload happen in a
+// single transaction, so the file's old rows and rejects are kept if the
+// reload fails. ReloadFile returns the number of rows deleted from each
+// table, and the number of rows loaded.
+func (l *Loader) ReloadFile(ctx context.Context, file string) (deleted map[string]int64, loaded int64, err error) {
+	reader := l.findReaderFilename(file)
+	if reader == nil {
+		return nil, 0, fmt.Errorf("no source for %s", file)
+	}
+	if _, err := os.Stat(reader.Path); err != nil {
+		return nil, 0, errors.Wrapf(err, "ReloadFile(%s)", file)
+	}
+	return l.reloadReader(ctx, reader)
+}
+
+// reloadReader deletes the rows and rejects loaded from reader's file and
+// loads the file again from the start, in one transaction (l.tx, if set).
+// Lines rejected by the reload are recorded in the same transaction.
+func (l *Loader) reloadReader(ctx context.Context, reader *Reader) (deleted map[string]int64, loaded int64, err error) {
+	file := reader.Filename
+	tx, err := l.beginTx(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	fail := func(err error) (map[string]int64, int64, error) {
+		l.rollbackTx(tx)
+		return nil, 0, err
+	}
+
+	w := l.worker()
+	w.tx = tx
+	w.OnRewrite = RewriteStop
+	if deleted, err = w.fileRowCounts(ctx, tx, file); err != nil {
+		return fail(err)
+	}
+	if _, err = w.deleteFileRowsTx(ctx, tx, file); err != nil {
+		return fail(errors.Wrapf(err, "deleteFileRows(%s)", file))
+	}
+	if err = deleteFileRejects(ctx, tx, file); err != nil {
+		return fail(err)
+	}
+
+	r := w.newReader(reader.XlogSrc)
+	defer r.Close()
+	w.Readers = append(w.Readers, r)
+	if err = w.LoadCommitLog(ctx, r.TargetPath); err != nil {
+		return fail(err)
+	}
+	if err = l.commitTx(tx); err != nil {
+		return nil, 0, errors.Wrapf(err, "reload %s: commit", file)
+	}
+	log.Printf("Reloaded %s: %d rows\n", file, w.RowCount)
+
+	// Lookup caches may refer to the deleted rows.
+	l.createTableLookups()
+	return deleted, w.RowCount, nil
+}
+
+// A RowCounter is a RowWriter that counts the rows written to each table,
+// such as to report the rows a load would insert.
+type RowCounter map[string]int64
+
+// WriteRow counts a row in table.
+func (c RowCounter) WriteRow(table string, columns []string, values []interface{}) error {
+	c[table]++
+	return nil
+}
+
+// Flush does nothing.
+func (c RowCounter) Flush() error {
+	return nil
+}
@@ -0,0 +1,125 @@
+package loader
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	cdb "github.com/crawl/go-sequell/crawl/db"
+	"github.com/pkg/errors"
+)
+
+// A RewritePolicy specifies what the loader does when an xlog file no longer
+// matches the offset and checksum recorded in l_file, i.e. when the file has
+// been truncated, rotated, or otherwise rewritten on the server.
+type RewritePolicy string
+
+// Rewrite policies.
+const (
+	// RewriteStop fails the load with an error.
+	RewriteStop RewritePolicy = "stop"
+
+	// RewriteReload deletes all rows loaded from the file and reloads the
+	// file from the start.
+	RewriteReload RewritePolicy = "reload"
+
+	// RewriteSkip logs a warning and leaves the file alone.
+	RewriteSkip RewritePolicy = "skip"
+)
+
+// RewritePolicies is the list of valid rewrite policies.
+var RewritePolicies = []RewritePolicy{RewriteStop, RewriteReload, RewriteSkip}
+
+// ParseRewritePolicy parses a rewrite policy name. An empty name is the
+// default policy, RewriteStop.
+func ParseRewritePolicy(name string) (RewritePolicy, error) {
+	if name == "" {
+		return RewriteStop, nil
+	}
+	for _, p := range RewritePolicies {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown rewrite policy %#v (expected one of %v)",
+		name, RewritePolicies)
+}
+
+// ErrFileRewritten is the error reported when a rewritten file is found and
+// the rewrite policy is RewriteStop.
+type ErrFileRewritten struct {
+	File   string
+	Offset int64
+}
+
+func (e ErrFileRewritten) Error() string {
+	return fmt.Sprintf("%s: file does not match the line loaded at offset %d (was it truncated or rewritten? see --on-rewrite)",
+		e.File, e.Offset)
+}
+
+// handleRewrite applies l's rewrite policy to the rewritten file read by
+// reader. With RewriteReload, the file's rows are deleted and the file is
+// loaded again from the start in a single transaction, so the old rows are
+// kept if the reload fails.
+func (l *Loader) handleRewrite(ctx context.Context, reader *Reader, offset int64) error {
+	switch l.OnRewrite {
+	case RewriteSkip:
+		log.Printf("Skipping rewritten file: %s (offset %d no longer matches)\n",
+			reader.Filename, offset)
+		return nil
+	case RewriteReload:
+		log.Printf("Reloading rewritten file: %s (offset %d no longer matches)\n",
+			reader.Filename, offset)
+		_, loaded, err := l.reloadReader(ctx, reader)
+		if err != nil {
+			return errors.Wrapf(err, "reload %s", reader.Filename)
+		}
+		l.RowCount += loaded
+		return nil
+	default:
+		return ErrFileRewritten{File: reader.Filename, Offset: offset}
+	}
+}
+
+// deleteFileRowsTx deletes the file's l_file row in tx, and with it (by
+// cascading delete) all game and milestone rows loaded from the file,
+// returning false if file was never loaded. Rows in globally unique lookup
+// tables (such as game hashes) that belong to the file's rows are also
+// deleted so that the rows may be loaded again.
+func (l *Loader) deleteFileRowsTx(ctx context.Context, tx *sql.Tx, file string) (bool, error) {
+	fileTable := l.Schema.LookupTable(cdb.FileLookupTable)
+	if fileTable == nil {
+		return false, fmt.Errorf("schema has no %s lookup table", cdb.FileLookupTable)
+	}
+	fileID := `(select id from ` + fileTable.TableName() + ` where file = $1)`
+	for _, prefix := range l.Schema.TableVariantPrefixes {
+		for _, table := range l.Schema.Tables {
+			fileField := table.FindField(cdb.FileLookupTable)
+			if fileField == nil {
+				continue
+			}
+			tableName := prefix + table.Name
+			for _, f := range table.Fields {
+				if !f.UUID || !f.ForeignKeyLookup {
+					continue
+				}
+				lookup := l.Schema.FindLookupTableForField(f.Name)
+				query := `delete from ` + lookup.TableName() + ` where id in
+								(select ` + f.RefName() + ` from ` + tableName + `
+								  where ` + fileField.RefName() + ` = ` + fileID + `)`
+				if _, err := tx.ExecContext(ctx, query, NormalizeValue(file)); err != nil {
+					return false, errors.Wrap(err, query)
+				}
+			}
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `delete from `+fileTable.TableName()+` where file = $1`,
+		NormalizeValue(file))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
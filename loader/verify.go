@@ -0,0 +1,332 @@
+package loader
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/crawl/go-sequell/crawl/db"
+	"github.com/crawl/go-sequell/crawl/xlogtools"
+	"github.com/crawl/go-sequell/xlog"
+	"github.com/pkg/errors"
+)
+
+// verifyExamples is the number of examples of each kind of discrepancy
+// shown in a verification report.
+const verifyExamples = 5
+
+// A VerifyResult is the comparison of the rows loaded from a file with the
+// rows in the db.
+type VerifyResult struct {
+	File string
+
+	// FileRows is the number of rows read from the file up to its loaded
+	// offset, and DBRows the number of rows in the db for the file.
+	FileRows int
+	DBRows   int
+
+	// Missing are rows in the file that are not in the db; Extra rows in
+	// the db that are not in the file; and Changed rows that are in both,
+	// but have fields that the current normalizer normalizes differently.
+	Missing []VerifyRow
+	Extra   []VerifyRow
+	Changed []VerifyDiff
+
+	// Repaired is the number of missing rows inserted by a repair; rows
+	// that duplicate rows already in the db are not inserted.
+	Repaired int
+}
+
+// A VerifyRow is a row read from a file (identified by its offset) or from
+// the db (identified by its id).
+type VerifyRow struct {
+	Key    string
+	Offset string
+	ID     int64
+}
+
+// A VerifyDiff is a row whose fields in the db differ from the fields
+// normalized from the file.
+type VerifyDiff struct {
+	VerifyRow
+	Fields []VerifyField
+}
+
+// A VerifyField is a field whose value in the db differs from its value
+// normalized from the file.
+type VerifyField struct {
+	Field    string
+	DB, File string
+}
+
+// OK returns true if the db matches the file.
+func (v *VerifyResult) OK() bool {
+	return len(v.Missing) == 0 && len(v.Extra) == 0 && len(v.Changed) == 0
+}
+
+// Write writes a summary of v, with a few examples of each discrepancy, to w.
+func (v *VerifyResult) Write(w io.Writer) {
+	status := "ok"
+	if !v.OK() {
+		status = "MISMATCH"
+	}
+	fmt.Fprintf(w, "%s: %s: %d file rows, %d db rows, %d missing, %d extra, %d changed",
+		v.File, status, v.FileRows, v.DBRows, len(v.Missing), len(v.Extra), len(v.Changed))
+	if v.Repaired > 0 {
+		fmt.Fprintf(w, ", %d repaired", v.Repaired)
+	}
+	fmt.Fprintln(w)
+	for i, r := range v.Missing {
+		if i == verifyExamples {
+			break
+		}
+		fmt.Fprintf(w, "  missing: offset %s: %s\n", r.Offset, r.Key)
+	}
+	for i, r := range v.Extra {
+		if i == verifyExamples {
+			break
+		}
+		fmt.Fprintf(w, "  extra: id %d: %s\n", r.ID, r.Key)
+	}
+	for i, d := range v.Changed {
+		if i == verifyExamples {
+			break
+		}
+		fmt.Fprintf(w, "  changed: offset %s, id %d: %s\n", d.Offset, d.ID, d.Key)
+		for _, f := range d.Fields {
+			fmt.Fprintf(w, "    %s: db %q, file %q\n", f.Field, f.DB, f.File)
+		}
+	}
+}
+
+// verifyRow is a row's values as text, in the order of its table's insert
+// fields.
+type verifyRow struct {
+	VerifyRow
+	values []string
+}
+
+// rowKey returns the key that identifies a row given its field names and
+// values: its game key and end or milestone time.
+func rowKey(names []string, values []string) string {
+	var gameKey, rowTime string
+	for i, k := range names {
+		switch k {
+		case "game_key":
+			gameKey = values[i]
+		case "rend", "rtime":
+			rowTime = values[i]
+		}
+	}
+	return gameKey + " " + rowTime
+}
+
+// verifyQuery builds the query that selects the id and insert fields (as
+// text, with lookups resolved) of the rows in table loaded from a file.
+func verifyQuery(table string, fields []*db.Field) string {
+	columns := []string{"t.id"}
+	joins := []string{}
+	for i, f := range fields {
+		expr := "t." + f.SQLName
+		if f.ForeignKeyLookup {
+			alias := "j" + strconv.Itoa(i)
+			joins = append(joins, "left join "+f.ForeignKeyTable+" as "+alias+
+				" on t."+f.RefName()+" = "+alias+".id")
+			expr = alias + "." + f.SQLName
+		}
+		columns = append(columns, expr+"::text")
+	}
+	return "select " + strings.Join(columns, ", ") + " from " + table + " as t " +
+		strings.Join(joins, " ") +
+		" where t." + db.FileLookupTable + "_id = (select id from l_file where file = $1)" +
+		" order by t.id"
+}
+
+// verifyValue returns the canonical form of a field value for comparison.
+func verifyValue(f *db.Field, value string) string {
+	switch value {
+	case "true":
+		if strings.Contains(strings.ToLower(f.SQLType), "bool") {
+			return "t"
+		}
+	case "false":
+		if strings.Contains(strings.ToLower(f.SQLType), "bool") {
+			return "f"
+		}
+	}
+	return LookupKey(value, f.CaseSensitive || !f.ForeignKeyLookup)
+}
+
+// queryVerifyRows reads the rows of reader's table that were loaded from
+// reader's file, grouped by key. All of the file's rows are held in memory
+// (as text), since the db's rows need not be in the file's order: a large
+// logfile can need hundreds of megabytes.
+func (l *Loader) queryVerifyRows(ctx context.Context, reader *Reader, fields []*db.Field, names []string) (map[string][]*verifyRow, int, error) {
+	rows, err := l.DB.QueryContext(ctx, verifyQuery(reader.Table, fields), NormalizeValue(reader.Filename))
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "verify %s", reader.Filename)
+	}
+	defer rows.Close()
+
+	byKey := map[string][]*verifyRow{}
+	values := make([]sql.NullString, len(fields))
+	dest := make([]interface{}, len(fields)+1)
+	for i := range values {
+		dest[i+1] = &values[i]
+	}
+	n := 0
+	for rows.Next() {
+		row := &verifyRow{values: make([]string, len(fields))}
+		dest[0] = &row.ID
+		if err = rows.Scan(dest...); err != nil {
+			return nil, 0, err
+		}
+		for i, v := range values {
+			row.values[i] = verifyValue(fields[i], v.String)
+		}
+		row.Key = rowKey(names, row.values)
+		byKey[row.Key] = append(byKey[row.Key], row)
+		n++
+	}
+	return byKey, n, rows.Err()
+}
+
+// matchVerifyRow removes and returns the row in candidates with values, or
+// else the first candidate.
+func matchVerifyRow(candidates []*verifyRow, values []string) (*verifyRow, []*verifyRow) {
+	match := 0
+	for i, c := range candidates {
+		if equalStrings(c.values, values) {
+			match = i
+			break
+		}
+	}
+	row := candidates[match]
+	return row, append(candidates[:match], candidates[match+1:]...)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyFile reads file (a reader's db filename) up to its offset in l_file,
+// normalizes each row with l's normalizer, and compares the rows with the db.
+// If repair is set, rows missing from the db are inserted; offsets in l_file
+// are not changed. The file's rows in the db are read into memory first; see
+// queryVerifyRows.
+func (l *Loader) VerifyFile(ctx context.Context, file string, repair bool) (*VerifyResult, error) {
+	src := l.findReaderFilename(file)
+	if src == nil {
+		return nil, fmt.Errorf("no source for %s", file)
+	}
+	res := &VerifyResult{File: file}
+	loadedOffset, _, err := l.querySeekPosition(ctx, file)
+	if err != nil {
+		return nil, errors.Wrap(err, "QuerySeekOffset")
+	}
+
+	reader := l.newReader(src.XlogSrc)
+	defer reader.Close()
+	baseTable := reader.Type.BaseTable()
+	fields := l.tableInsertFields[baseTable]
+	names, _ := l.dryRunKeys(baseTable)
+	dbRows, ndb, err := l.queryVerifyRows(ctx, reader, fields, names)
+	if err != nil {
+		return nil, err
+	}
+	res.DBRows = ndb
+
+	w := l.worker()
+	w.keepFileOffsets = true
+	row := make([]interface{}, len(names))
+	for loadedOffset >= 0 {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		x, err := reader.Next()
+		if err == xlog.ErrNoFile {
+			return res, errors.Wrapf(err, "verify %s", file)
+		}
+		if err != nil {
+			return res, errors.Wrap(err, "reader.Next")
+		}
+		if x == nil {
+			break
+		}
+		offset, _ := strconv.ParseInt(x[":offset"], 10, 64)
+		if offset > loadedOffset {
+			break
+		}
+		if !xlogtools.ValidXlog(x) {
+			continue
+		}
+		if err = ReaderNormalizedLog(reader, l.LogNorm, x); err != nil {
+			log.Printf("Verify: %s offset=%d: %s\n", file, offset, err)
+			continue
+		}
+		res.FileRows++
+
+		loadXlogRow(row, names, l.tableInsertDefaults[baseTable], x)
+		values := make([]string, len(names))
+		for i, v := range row {
+			values[i] = verifyValue(fields[i], v.(string))
+		}
+		fileRow := VerifyRow{Key: rowKey(names, values), Offset: x[":offset"]}
+		candidates := dbRows[fileRow.Key]
+		if len(candidates) == 0 {
+			res.Missing = append(res.Missing, fileRow)
+			if repair {
+				w.noteFileSource(reader)
+				if err = w.addNormalizedLog(ctx, x); err != nil {
+					return res, err
+				}
+			}
+			continue
+		}
+		var dbRow *verifyRow
+		dbRow, dbRows[fileRow.Key] = matchVerifyRow(candidates, values)
+		if diff := verifyDiff(names, dbRow.values, values); len(diff) > 0 {
+			fileRow.ID = dbRow.ID
+			res.Changed = append(res.Changed, VerifyDiff{VerifyRow: fileRow, Fields: diff})
+		}
+	}
+	if repair {
+		err = w.Commit(ctx)
+		res.Repaired = int(w.RowCount)
+		if err != nil {
+			return res, err
+		}
+	}
+
+	for _, rows := range dbRows {
+		for _, r := range rows {
+			res.Extra = append(res.Extra, r.VerifyRow)
+		}
+	}
+	sort.Slice(res.Extra, func(i, j int) bool { return res.Extra[i].ID < res.Extra[j].ID })
+	return res, nil
+}
+
+// verifyDiff returns the fields that differ between dbValues and fileValues.
+func verifyDiff(names, dbValues, fileValues []string) []VerifyField {
+	var diff []VerifyField
+	for i := range names {
+		if dbValues[i] != fileValues[i] {
+			diff = append(diff, VerifyField{Field: names[i], DB: dbValues[i], File: fileValues[i]})
+		}
+	}
+	return diff
+}
@@ -0,0 +1,102 @@
+package loader
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crawl/go-sequell/crawl/db"
+)
+
+func TestRowKey(t *testing.T) {
+	tests := []struct {
+		names, values []string
+		key           string
+	}{
+		{[]string{"name", "game_key", "rend"}, []string{"Inkie", "Inkie:cao:20140808162913S", "20140808162913S"},
+			"Inkie:cao:20140808162913S 20140808162913S"},
+		{[]string{"rtime", "game_key", "verb"}, []string{"20140808150000S", "Inkie:cao:20140808162913S", "uniq"},
+			"Inkie:cao:20140808162913S 20140808150000S"},
+		{[]string{"name"}, []string{"Inkie"}, " "},
+	}
+	for _, test := range tests {
+		if key := rowKey(test.names, test.values); key != test.key {
+			t.Errorf("rowKey(%#v, %#v) = %#v, expected %#v", test.names, test.values, key, test.key)
+		}
+	}
+}
+
+func TestVerifyValue(t *testing.T) {
+	boolField := &db.Field{Name: "tiles", SQLType: "BOOLEAN"}
+	textField := &db.Field{Name: "tmsg", SQLType: "citext"}
+	lookupField := &db.Field{Name: "killer", SQLType: "citext", ForeignKeyLookup: true}
+	caseLookupField := &db.Field{Name: "name", SQLType: "citext", ForeignKeyLookup: true, CaseSensitive: true}
+	tests := []struct {
+		field        *db.Field
+		value, canon string
+	}{
+		{boolField, "true", "t"},
+		{boolField, "false", "f"},
+		{boolField, "t", "t"},
+		{textField, "true", "true"},
+		{textField, "Slain by an Ogre", "Slain by an Ogre"},
+		{lookupField, "an Ogre", "an ogre"},
+		{caseLookupField, "Inkie", "Inkie"},
+	}
+	for _, test := range tests {
+		if canon := verifyValue(test.field, test.value); canon != test.canon {
+			t.Errorf("verifyValue(%s, %#v) = %#v, expected %#v", test.field.Name, test.value, canon, test.canon)
+		}
+	}
+}
+
+func TestMatchVerifyRow(t *testing.T) {
+	newRow := func(id int64, values ...string) *verifyRow {
+		return &verifyRow{VerifyRow: VerifyRow{ID: id}, values: values}
+	}
+	tests := []struct {
+		values    []string
+		matchID   int64
+		remaining []int64
+	}{
+		{[]string{"Inkie", "D:3"}, 2, []int64{1, 3}},
+		{[]string{"Inkie", "D:1"}, 1, []int64{2, 3}},
+		{[]string{"Inkie", "Lair:2"}, 1, []int64{2, 3}},
+	}
+	for _, test := range tests {
+		candidates := []*verifyRow{newRow(1, "Inkie", "D:1"), newRow(2, "Inkie", "D:3"), newRow(3, "Inkie", "D:3")}
+		row, rest := matchVerifyRow(candidates, test.values)
+		restIDs := []int64{}
+		for _, r := range rest {
+			restIDs = append(restIDs, r.ID)
+		}
+		if row.ID != test.matchID || !reflect.DeepEqual(restIDs, test.remaining) {
+			t.Errorf("matchVerifyRow(%#v) = %d, %v; expected %d, %v", test.values, row.ID, restIDs, test.matchID, test.remaining)
+		}
+	}
+}
+
+func TestVerifyDiff(t *testing.T) {
+	names := []string{"name", "place", "god"}
+	if diff := verifyDiff(names, []string{"Inkie", "D:3", "Okawaru"}, []string{"Inkie", "D:3", "Okawaru"}); len(diff) != 0 {
+		t.Errorf("verifyDiff of equal rows = %#v, expected none", diff)
+	}
+	diff := verifyDiff(names, []string{"Inkie", "Vault:1", "Okawaru"}, []string{"Inkie", "Vaults:1", "Okawaru"})
+	expected := []VerifyField{{Field: "place", DB: "Vault:1", File: "Vaults:1"}}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("verifyDiff = %#v, expected %#v", diff, expected)
+	}
+}
+
+func TestVerifyQuery(t *testing.T) {
+	fields := []*db.Field{
+		{Name: "name", SQLName: "pname", ForeignKeyLookup: true, ForeignKeyTable: "l_name"},
+		{Name: "xl", SQLName: "xl"},
+	}
+	query := verifyQuery("logrecord", fields)
+	expected := "select t.id, j0.pname::text, t.xl::text from logrecord as t " +
+		"left join l_name as j0 on t.pname_id = j0.id" +
+		" where t.file_id = (select id from l_file where file = $1) order by t.id"
+	if query != expected {
+		t.Errorf("verifyQuery =\n%s\nexpected\n%s", query, expected)
+	}
+}
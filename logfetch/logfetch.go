@@ -2,9 +2,13 @@ package logfetch
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"time"
 
 	"github.com/crawl/go-sequell/httpfetch"
 	"github.com/crawl/go-sequell/sources"
+	"github.com/pkg/errors"
 )
 
 // XlogSourcePredicate filters xlog sources.
@@ -42,8 +46,9 @@ func sourceFetchRequests(incremental bool, src []*sources.XlogSrc) []*httpfetch.
 			panic(err)
 		}
 		res = append(res, &httpfetch.FetchRequest{
-			URL:      s.URL,
-			Filename: s.TargetPath,
+			URL:         s.URL,
+			Filename:    s.TargetPath,
+			Compression: s.Compression,
 		})
 	}
 	return res
@@ -62,15 +67,74 @@ func New() *Fetcher {
 }
 
 // DownloadAndWait downloads all xlog files, blocking until the download
-// completes. If incremental, skips files that are no longer active.
-func (f *Fetcher) DownloadAndWait(files []*sources.XlogSrc, incremental bool) {
-	f.Download(files, incremental)
+// completes. If incremental, skips files that are no longer active. Returns
+// the result of every download, and a FetchErrors error if any failed.
+// Cancelling ctx abandons all downloads.
+func (f *Fetcher) DownloadAndWait(ctx context.Context, files []*sources.XlogSrc, incremental bool) ([]*httpfetch.FetchResult, error) {
+	results := []*httpfetch.FetchResult{}
+	for res := range f.Download(ctx, files, incremental) {
+		results = append(results, res)
+	}
 	f.HTTPFetch.Shutdown()
+	return results, ResultErrors(results)
 }
 
 // Download triggers an async download of all xlog files. If incremental,
-// skips files that are no longer active.
-func (f *Fetcher) Download(files []*sources.XlogSrc, incremental bool) {
+// skips files that are no longer active. The returned channel receives the
+// result of each download, and is closed when all downloads are complete.
+// Cancelling ctx abandons all downloads.
+func (f *Fetcher) Download(ctx context.Context, files []*sources.XlogSrc, incremental bool) <-chan *httpfetch.FetchResult {
 	req := sourceFetchRequests(incremental, files)
-	f.HTTPFetch.QueueFetch(req)
+	return f.HTTPFetch.Fetch(ctx, req)
+}
+
+// ResultErrors returns a FetchErrors listing the errors in results, or nil if
+// all fetches succeeded.
+func ResultErrors(results []*httpfetch.FetchResult) error {
+	var errs FetchErrors
+	for _, res := range results {
+		if res.Err != nil {
+			errs = append(errs, errors.Wrap(res.Err, res.Req.URL))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// A Summary totals the results of a set of downloads.
+type Summary struct {
+	Files       int
+	Changed     int
+	NotModified int
+	Failed      int
+	Bytes       int64
+	Duration    time.Duration
+}
+
+// Summarize totals results. The summary's Duration is the longest single
+// fetch duration.
+func Summarize(results []*httpfetch.FetchResult) Summary {
+	sum := Summary{Files: len(results)}
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			sum.Failed++
+		case res.NotModified:
+			sum.NotModified++
+		case res.Changed():
+			sum.Changed++
+		}
+		sum.Bytes += res.DownloadSize
+		if res.Duration > sum.Duration {
+			sum.Duration = res.Duration
+		}
+	}
+	return sum
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("%d files: %d changed, %d not modified, %d failed; %d bytes, slowest %s",
+		s.Files, s.Changed, s.NotModified, s.Failed, s.Bytes, s.Duration)
 }
@@ -0,0 +1,249 @@
+// Package metrics collects counters, gauges and summaries and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry that Sequell's packages register their metrics in.
+var Default = NewRegistry()
+
+// Metric types.
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	typeSummary = "summary"
+)
+
+// A Registry is a set of named metrics. All methods are safe for concurrent
+// use.
+type Registry struct {
+	mutex    sync.Mutex
+	families []*family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// family is a metric with a fixed set of label names, and a value (or sum and
+// count, for summaries) for each distinct set of label values.
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	series     map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	count       uint64
+}
+
+func (r *Registry) register(name, help, metricType string, labelNames []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		series:     map[string]*series{},
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// update applies fn to the series for labelValues, creating the series if
+// necessary.
+func (r *Registry) update(f *family, labelValues []string, fn func(s *series)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects labels %v, got %v",
+			f.name, f.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\x00")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := f.series[key]
+	if s == nil {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		f.series[key] = s
+	}
+	fn(s)
+}
+
+func (r *Registry) value(f *family, labelValues []string) (float64, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if s := f.series[strings.Join(labelValues, "\x00")]; s != nil {
+		return s.value, s.count
+	}
+	return 0, 0
+}
+
+// A Counter is a value that only increases, such as a count of requests.
+type Counter struct {
+	registry *Registry
+	family   *family
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{r, r.register(name, help, typeCounter, labelNames)}
+}
+
+// Add adds v to the counter with the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.registry.update(c.family, labelValues, func(s *series) { s.value += v })
+}
+
+// Inc increments the counter with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the counter's current value for the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	v, _ := c.registry.value(c.family, labelValues)
+	return v
+}
+
+// A Gauge is a value that may go up or down, such as a queue length.
+type Gauge struct {
+	registry *Registry
+	family   *family
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{r, r.register(name, help, typeGauge, labelNames)}
+}
+
+// Set sets the gauge with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.registry.update(g.family, labelValues, func(s *series) { s.value = v })
+}
+
+// Add adds v (which may be negative) to the gauge with the given label
+// values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.registry.update(g.family, labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the gauge's current value for the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	v, _ := g.registry.value(g.family, labelValues)
+	return v
+}
+
+// A Summary tracks the count and sum of observations, such as request
+// durations.
+type Summary struct {
+	registry *Registry
+	family   *family
+}
+
+// NewSummary registers a summary with the given label names.
+func (r *Registry) NewSummary(name, help string, labelNames ...string) *Summary {
+	return &Summary{r, r.register(name, help, typeSummary, labelNames)}
+}
+
+// Observe records an observation v for the given label values.
+func (s *Summary) Observe(v float64, labelValues ...string) {
+	s.registry.update(s.family, labelValues, func(s *series) {
+		s.value += v
+		s.count++
+	})
+}
+
+// Count returns the number of observations for the given label values.
+func (s *Summary) Count(labelValues ...string) uint64 {
+	_, count := s.registry.value(s.family, labelValues)
+	return count
+}
+
+// WriteText writes all metrics to w in the Prometheus text format. Metrics
+// with no recorded values are omitted.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, f := range r.families {
+		if len(f.series) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", f.name, f.metricType)
+		for _, s := range f.sortedSeries() {
+			labels := f.labelText(s.labelValues)
+			if f.metricType == typeSummary {
+				fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, labels, formatValue(s.value))
+				fmt.Fprintf(buf, "%s_count%s %d\n", f.name, labels, s.count)
+				continue
+			}
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, labels, formatValue(s.value))
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler returns an HTTP handler that serves r's metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+func (f *family) sortedSeries() []*series {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]*series, len(keys))
+	for i, k := range keys {
+		res[i] = f.series[k]
+	}
+	return res
+}
+
+func (f *family) labelText(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, v := range values {
+		pairs[i] = f.labelNames[i] + `="` + labelEscaper.Replace(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
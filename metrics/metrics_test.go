@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests made.", "host", "status")
+	queued := r.NewGauge("queued", "Queued requests.")
+	latency := r.NewSummary("latency_seconds", "Request latency.", "host")
+	r.NewCounter("unused_total", "Never incremented.")
+
+	requests.Inc("cao", "200")
+	requests.Add(2, "cao", "200")
+	requests.Inc(`c"bro`, "404")
+	queued.Set(5)
+	queued.Add(-2)
+	latency.Observe(0.5, "cao")
+	latency.Observe(1.25, "cao")
+
+	if v := requests.Value("cao", "200"); v != 3 {
+		t.Errorf("requests{cao,200} = %g, expected 3", v)
+	}
+	if c := latency.Count("cao"); c != 2 {
+		t.Errorf("latency{cao} count = %d, expected 2", c)
+	}
+
+	var buf bytes.Buffer
+	if err := r.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText failed: %s", err)
+	}
+	expected := `# HELP requests_total Requests made.
+# TYPE requests_total counter
+requests_total{host="c\"bro",status="404"} 1
+requests_total{host="cao",status="200"} 3
+# HELP queued Queued requests.
+# TYPE queued gauge
+queued 3
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds summary
+latency_seconds_sum{host="cao"} 1.75
+latency_seconds_count{host="cao"} 2
+`
+	if actual := buf.String(); actual != expected {
+		t.Errorf("WriteText wrote:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
@@ -175,9 +175,13 @@ func (p DB) normalizeType(sqlType, defval string, precision int64) (string, stri
 		sqlType = "int"
 	}
 	// Sequences are normalized to serial.
-	if strings.Index(defval, "nextval(") != -1 && sqlType == "int" {
-		sqlType = "serial"
-		defval = ""
+	if strings.Index(defval, "nextval(") != -1 {
+		switch sqlType {
+		case "int":
+			sqlType, defval = "serial", ""
+		case "bigint":
+			sqlType, defval = "bigserial", ""
+		}
 	}
 	if sqlType == "numeric" && precision > 0 {
 		sqlType = "numeric(" + strconv.FormatInt(precision, 10) + ")"
@@ -51,3 +51,10 @@ func (p DB) ExtensionExists(ext string) (bool, error) {
 func (p DB) UserExists(user string) (bool, error) {
 	return p.RowExists(`select * from pg_user where usename = $1`, user)
 }
+
+// TableExists checks if the table exists in the public schema.
+func (p DB) TableExists(table string) (bool, error) {
+	return p.RowExists(`select * from information_schema.tables
+                                where table_schema = 'public' and table_name = $1`,
+		table)
+}
@@ -61,10 +61,12 @@ func (s *Schema) DiffSchema(old *Schema) *Schema {
 // DiffSchema compares t to old and returns a diff table.
 func (t *Table) DiffSchema(old *Table) *Table {
 	if old == nil {
-		return &Table{
-			Name:       t.Name,
-			DiffStruct: &DiffStruct{Added},
-		}
+		// Added tables carry their full definition so that they can be
+		// created by an upgrade.
+		added := *t
+		added.knownDeps = nil
+		added.DiffStruct = &DiffStruct{Added}
+		return &added
 	}
 
 	diffTable := Table{
@@ -0,0 +1,151 @@
+package schema
+
+// UpgradeSQL returns the DDL statements that bring a database up to date,
+// where s is a diff schema as returned by DiffSchema. Statements are ordered
+// so that they may be applied in sequence: new tables first (in dependency
+// order), then new columns, then indexes, and finally constraints.
+//
+// Changed columns (type or default changes) are not included: use
+// ChangedColumns to find columns that must be migrated by hand.
+func (s *Schema) UpgradeSQL() []string {
+	s.Sort()
+	return append(
+		append(
+			append(s.sqlTableMap((*Table).UpgradeTableSQL),
+				s.sqlTableMap((*Table).UpgradeColumnSQL)...),
+			s.sqlTableMap((*Table).UpgradeIndexSQL)...),
+		s.sqlTableMap((*Table).UpgradeConstraintSQL)...)
+}
+
+// ChangedColumns returns the list of columns in the diff schema s whose
+// definitions have changed, grouped by table name. Such changes cannot be
+// applied automatically by UpgradeSQL.
+func (s *Schema) ChangedColumns() map[string][]*Column {
+	res := map[string][]*Column{}
+	for _, t := range s.Tables {
+		if t.Diff != Changed {
+			continue
+		}
+		for _, c := range t.Columns {
+			if c.Diff == Changed {
+				res[t.Name] = append(res[t.Name], c)
+			}
+		}
+	}
+	return res
+}
+
+// UpgradeTableSQL returns the DDL to create t if t is a newly added table in
+// a diff schema.
+func (t *Table) UpgradeTableSQL() []string {
+	if t.Diff != Added {
+		return nil
+	}
+	return t.SQLNoIndexesConstraints()
+}
+
+// UpgradeColumnSQL returns the DDL to add new columns to t, where t is a
+// changed table in a diff schema.
+func (t *Table) UpgradeColumnSQL() []string {
+	if t.Diff != Changed {
+		return nil
+	}
+	sqls := []string{}
+	for _, c := range t.Columns {
+		if c.Diff == Added {
+			sqls = append(sqls, "alter table "+t.Name+" add column "+c.SQL())
+		}
+	}
+	return sqls
+}
+
+// UpgradeIndexSQL returns the DDL to create indexes missing from t in a diff
+// schema.
+func (t *Table) UpgradeIndexSQL() []string {
+	sqls := []string{}
+	for _, index := range t.Indexes {
+		// Forced indexes on new tables are created with the table.
+		if t.Diff == Added && index.Force {
+			continue
+		}
+		sqls = append(sqls, index.SQL())
+	}
+	return sqls
+}
+
+// UpgradeConstraintSQL returns the DDL to add constraints missing from t in a
+// diff schema.
+func (t *Table) UpgradeConstraintSQL() []string {
+	sqls := []string{}
+	for _, c := range t.Constraints {
+		sqls = append(sqls, "alter table "+t.Name+" add "+c.SQL())
+	}
+	return sqls
+}
+
+// DowngradeSQL returns the DDL statements that revert the changes made by
+// UpgradeSQL for the diff schema s, in reverse order: constraints, indexes,
+// columns and finally tables are dropped.
+func (s *Schema) DowngradeSQL() []string {
+	s.Sort()
+	return append(
+		append(
+			append(s.sqlTableRevMap((*Table).DowngradeConstraintSQL),
+				s.sqlTableRevMap((*Table).DowngradeIndexSQL)...),
+			s.sqlTableRevMap((*Table).DowngradeColumnSQL)...),
+		s.sqlTableRevMap((*Table).DowngradeTableSQL)...)
+}
+
+// DowngradeTableSQL returns the DDL to drop t if t is a newly added table in a
+// diff schema.
+func (t *Table) DowngradeTableSQL() []string {
+	if t.Diff != Added {
+		return nil
+	}
+	return t.DropSQL()
+}
+
+// DowngradeColumnSQL returns the DDL to drop columns added to t in a diff
+// schema.
+func (t *Table) DowngradeColumnSQL() []string {
+	if t.Diff != Changed {
+		return nil
+	}
+	sqls := []string{}
+	for i := len(t.Columns) - 1; i >= 0; i-- {
+		if c := t.Columns[i]; c.Diff == Added {
+			sqls = append(sqls,
+				"alter table "+t.Name+" drop column if exists "+c.Name)
+		}
+	}
+	return sqls
+}
+
+// DowngradeIndexSQL returns the DDL to drop indexes added to t in a diff
+// schema. Indexes on new tables are dropped with their table.
+func (t *Table) DowngradeIndexSQL() []string {
+	if t.Diff == Added {
+		return nil
+	}
+	sqls := []string{}
+	for i := len(t.Indexes) - 1; i >= 0; i-- {
+		sqls = append(sqls, t.Indexes[i].DropSQL())
+	}
+	return sqls
+}
+
+// DowngradeConstraintSQL returns the DDL to drop constraints added to t in a
+// diff schema. Unnamed constraints cannot be dropped, and are skipped.
+func (t *Table) DowngradeConstraintSQL() []string {
+	if t.Diff == Added {
+		return nil
+	}
+	sqls := []string{}
+	for i := len(t.Constraints) - 1; i >= 0; i-- {
+		if name := t.Constraints[i].Name(); name != "" {
+			sqls = append(sqls,
+				"alter table "+t.Name+" drop constraint if exists "+name)
+		}
+	}
+	return sqls
+}
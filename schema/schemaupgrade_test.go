@@ -0,0 +1,86 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpgradeSQL(t *testing.T) {
+	lookup := &Table{
+		Name: "l_god",
+		Columns: []*Column{
+			{Name: "id", SQLType: "serial"},
+			{Name: "god", SQLType: "citext"},
+		},
+		Indexes: []*Index{
+			{Name: "ind_l_god_uniq_god", TableName: "l_god", Columns: []string{"god"}, Unique: true, Force: true},
+		},
+		Constraints: []Constraint{
+			PrimaryKeyConstraint{ConstraintName: "l_god_pk", Column: "id"},
+		},
+	}
+	wanted := &Schema{
+		Tables: []*Table{
+			{
+				Name: "logrecord",
+				Columns: []*Column{
+					{Name: "id", SQLType: "serial"},
+					{Name: "sc", SQLType: "bigint", Default: "default 0"},
+					{Name: "god_id", SQLType: "int"},
+				},
+				Indexes: []*Index{
+					{Name: "ind_logrecord_god_id", TableName: "logrecord", Columns: []string{"god_id"}},
+				},
+				Constraints: []Constraint{
+					ForeignKeyConstraint{
+						ConstraintName:   "logrecord_god_id_fk",
+						SourceTableField: "god_id",
+						TargetTable:      "l_god",
+						TargetTableField: "id",
+					},
+				},
+			},
+			lookup,
+		},
+	}
+	actual := &Schema{
+		Tables: []*Table{
+			{
+				Name: "logrecord",
+				Columns: []*Column{
+					{Name: "id", SQLType: "serial"},
+					{Name: "sc", SQLType: "int"},
+				},
+			},
+		},
+	}
+
+	diff := wanted.DiffSchema(actual)
+	expected := []string{
+		"create table l_god (\n  id serial,\n  god citext\n)",
+		"create unique index ind_l_god_uniq_god on l_god (god)",
+		"alter table logrecord add column god_id int",
+		"create index ind_logrecord_god_id on logrecord (god_id)",
+		"alter table l_god add constraint l_god_pk primary key (id)",
+		"alter table logrecord add constraint logrecord_god_id_fk foreign key (god_id) references l_god (id) on delete cascade",
+	}
+	if upgrade := diff.UpgradeSQL(); !reflect.DeepEqual(upgrade, expected) {
+		t.Errorf("UpgradeSQL() = %#v, expected %#v", upgrade, expected)
+	}
+
+	expectedDowngrade := []string{
+		"alter table logrecord drop constraint if exists logrecord_god_id_fk",
+		"drop index if exists ind_logrecord_god_id",
+		"alter table logrecord drop column if exists god_id",
+		"drop table if exists l_god",
+	}
+	if downgrade := diff.DowngradeSQL(); !reflect.DeepEqual(downgrade, expectedDowngrade) {
+		t.Errorf("DowngradeSQL() = %#v, expected %#v", downgrade, expectedDowngrade)
+	}
+
+	changed := diff.ChangedColumns()
+	if len(changed) != 1 || len(changed["logrecord"]) != 1 ||
+		changed["logrecord"][0].Name != "sc" {
+		t.Errorf("ChangedColumns() = %#v, expected logrecord.sc", changed)
+	}
+}
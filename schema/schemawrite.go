@@ -4,6 +4,8 @@ import (
 	"io"
 	"os"
 	"strings"
+
+	"github.com/crawl/go-sequell/text"
 )
 
 // Select specifies what database DDL statements are selected.
@@ -31,6 +33,13 @@ func SQLCombine(sqls []string) string {
 	return strings.Join(sqls, ";\n") + ";\n"
 }
 
+// Hash returns an opaque hash of the DDL for s, identifying the schema
+// revision. Tables are sorted before hashing, so the hash does not depend on
+// the order in which tables were defined.
+func (s *Schema) Hash() string {
+	return text.Hash(SQLCombine(s.Sort().SQL()))
+}
+
 // Write writes the SQL statements for schema, selected by sel to the writer.
 func (s *Schema) Write(sel Select, writer io.Writer) (int, error) {
 	return writer.Write([]byte(SQLCombine(s.SQLSel(sel))))
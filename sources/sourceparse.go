@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/crawl/go-sequell/compression"
 	"github.com/crawl/go-sequell/crawl/ctime"
 	"github.com/crawl/go-sequell/crawl/data"
 	"github.com/crawl/go-sequell/crawl/xlogtools"
@@ -76,12 +78,20 @@ func (s serverParser) Parse() (*Server, error) {
 		return nil, err
 	}
 
+	var fetchInterval time.Duration
+	if interval := s.server.String("fetch-interval"); interval != "" {
+		if fetchInterval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("%s: bad fetch-interval: %s", name, err)
+		}
+	}
+
 	server := Server{
 		Name:          name,
 		BaseURL:       s.server.String("base"),
 		LocalPathBase: s.server.String("local"),
 		TimeZoneMap:   tz,
 		UtcEpoch:      ctime.SafeParseTimeWithZone(s.server.String("utc-epoch")),
+		FetchInterval: fetchInterval,
 	}
 
 	if server.Logfiles, err =
@@ -169,15 +179,20 @@ func (p xlogSpecParser) ParseXlogAliased(aliased map[interface{}]interface{}) ([
 }
 
 func (p xlogSpecParser) NewXlogSrc(name, qualifier string, mustSync bool) *XlogSrc {
-	game := p.gameMatcher.XlogGame(name)
-	gameVersion := xlogtools.XlogGameVersion(name)
-	logtype := xlogtools.FileType(name)
+	// Compressed remote logs are decompressed into a target named for the
+	// uncompressed log:
+	format := compression.FilenameFormat(name)
+	logName := compression.StripExtension(name)
+
+	game := p.gameMatcher.XlogGame(logName)
+	gameVersion := xlogtools.XlogGameVersion(logName)
+	logtype := xlogtools.FileType(logName)
 	qualifiedName := xlogtools.XlogQualifiedName(p.server.Name, game, gameVersion, qualifier, logtype)
 
-	targetRelPath := URLTargetPath(p.server.Name, p.server.BaseURL, name)
+	targetRelPath := URLTargetPath(p.server.Name, p.server.BaseURL, logName)
 	targetPath := path.Join(p.cachedir, targetRelPath)
 	localPath := ""
-	if p.server.LocalPathBase != "" {
+	if p.server.LocalPathBase != "" && format == compression.None {
 		localPath = path.Join(p.server.LocalPathBase, name)
 	}
 	return &XlogSrc{
@@ -193,6 +208,7 @@ func (p xlogSpecParser) NewXlogSrc(name, qualifier string, mustSync bool) *XlogS
 		Type:          logtype,
 		Game:          game,
 		GameVersion:   gameVersion,
+		Compression:   format,
 	}
 }
 
@@ -3,7 +3,9 @@ package sources
 import (
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/crawl/go-sequell/compression"
 	"github.com/crawl/go-sequell/crawl/data"
 	"github.com/crawl/go-sequell/qyaml"
 )
@@ -58,6 +60,18 @@ func TestSources(t *testing.T) {
 			cao.Logfiles[0].TargetRelPath)
 	}
 
+	milestones03 := cao.Logfiles[2]
+	if milestones03.URL != "http://crawl.akrasiac.org/milestones03.bz2" ||
+		milestones03.TargetRelPath != "cao/milestones03" ||
+		milestones03.Compression != compression.Bzip2 {
+		t.Errorf("Expected CAO milestones03.bz2 to be decompressed to cao/milestones03, got %s (%#v)",
+			milestones03, milestones03.Compression)
+	}
+
+	if cao.FetchInterval != 5*time.Minute {
+		t.Errorf("Expected CAO fetch interval to be 5m, got %s", cao.FetchInterval)
+	}
+
 	if cao.TimeZoneMap.IsZero() {
 		t.Errorf("CAO has no tz map")
 	} else {
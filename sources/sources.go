@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/crawl/go-sequell/compression"
 	"github.com/crawl/go-sequell/crawl/ctime"
 	"github.com/crawl/go-sequell/crawl/xlogtools"
 )
@@ -41,6 +43,49 @@ func (x Servers) XlogSources() []*XlogSrc {
 	return sources
 }
 
+// FilterXlogs returns the xlogs whose descriptions (as returned by String())
+// contain any of the filter strings. If filters is empty, returns all xlogs.
+func FilterXlogs(xlogs []*XlogSrc, filters []string) []*XlogSrc {
+	if len(filters) == 0 {
+		return xlogs
+	}
+	res := make([]*XlogSrc, 0, len(xlogs))
+	for _, x := range xlogs {
+		desc := x.String()
+		for _, filter := range filters {
+			if strings.Contains(desc, filter) {
+				res = append(res, x)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// DiffXlogs compares the xlog sources in old and new by target path,
+// returning the sources in new that are not in old, and the sources in old
+// that are not in new. A source whose settings changed is both removed and
+// added.
+func DiffXlogs(old, new []*XlogSrc) (added, removed []*XlogSrc) {
+	oldByTarget := make(map[string]*XlogSrc, len(old))
+	for _, x := range old {
+		oldByTarget[x.TargetPath] = x
+	}
+	newByTarget := make(map[string]*XlogSrc, len(new))
+	for _, x := range new {
+		newByTarget[x.TargetPath] = x
+		if o := oldByTarget[x.TargetPath]; o == nil || !o.Equal(x) {
+			added = append(added, x)
+		}
+	}
+	for _, x := range old {
+		if n := newByTarget[x.TargetPath]; n == nil || !n.Equal(x) {
+			removed = append(removed, x)
+		}
+	}
+	return added, removed
+}
+
 // TargetLogDirs returns the set of target (local copy) log directories
 // for all log files.
 func (x Servers) TargetLogDirs() []string {
@@ -90,6 +135,10 @@ type Server struct {
 	TimeZoneMap   ctime.DSTLocation
 	UtcEpoch      time.Time
 	Logfiles      []*XlogSrc
+
+	// FetchInterval is how often isync fetches the server's live logs, or 0
+	// to use the default interval.
+	FetchInterval time.Duration
 }
 
 // ParseLogTime parses a timestamp as read from a server's logfile in the
@@ -121,12 +170,39 @@ type XlogSrc struct {
 	Type          xlogtools.XlogType
 	Game          string
 	GameVersion   string
+
+	// Compression is the compression format of the remote file, identified
+	// by its extension (.gz, .bz2, .xz). Compressed logs are decompressed
+	// into TargetPath, and are never linked from a local path.
+	Compression compression.Format
 }
 
 func (x *XlogSrc) String() string {
 	return "Src" + x.liveAsterisk() + "[" + x.Type.String() + ": " + x.URL + " > " + x.TargetPath + "]"
 }
 
+// Equal returns true if x and o describe the same log with the same
+// settings, including the settings of their servers that affect how the log
+// is loaded.
+func (x *XlogSrc) Equal(o *XlogSrc) bool {
+	if x.Name != o.Name || x.Qualifier != o.Qualifier ||
+		x.LocalPath != o.LocalPath || x.URL != o.URL ||
+		x.TargetPath != o.TargetPath || x.TargetRelPath != o.TargetRelPath ||
+		x.CName != o.CName || x.Live != o.Live || x.Type != o.Type ||
+		x.Game != o.Game || x.GameVersion != o.GameVersion ||
+		x.Compression != o.Compression {
+		return false
+	}
+	if x.Server == nil || o.Server == nil {
+		return x.Server == o.Server
+	}
+	return x.Server.Name == o.Server.Name &&
+		x.Server.BaseURL == o.Server.BaseURL &&
+		x.Server.LocalPathBase == o.Server.LocalPathBase &&
+		x.Server.TimeZoneMap.String() == o.Server.TimeZoneMap.String() &&
+		x.Server.UtcEpoch.Equal(o.Server.UtcEpoch)
+}
+
 func (x *XlogSrc) liveAsterisk() string {
 	if x.Live {
 		return "*"
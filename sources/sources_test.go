@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -30,3 +31,58 @@ func TestMakeTargetDir(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterXlogs(t *testing.T) {
+	xlogs := []*XlogSrc{
+		{URL: "http://crawl.akrasiac.org/logfile-git", TargetPath: "cao/logfile-git"},
+		{URL: "http://crawl.akrasiac.org/milestones-git", TargetPath: "cao/milestones-git"},
+		{URL: "https://underhound.eu/logfile-git", TargetPath: "cue/logfile-git"},
+	}
+	for _, c := range []struct {
+		filters  []string
+		expected int
+	}{
+		{nil, 3},
+		{[]string{"akrasiac"}, 2},
+		{[]string{"milestones", "underhound"}, 2},
+		{[]string{"cdo"}, 0},
+	} {
+		if actual := FilterXlogs(xlogs, c.filters); len(actual) != c.expected {
+			t.Errorf("FilterXlogs(%#v) returned %d xlogs, expected %d", c.filters, len(actual), c.expected)
+		}
+	}
+}
+
+func TestDiffXlogs(t *testing.T) {
+	cao := &Server{Name: "cao"}
+	cue := &Server{Name: "cue"}
+	old := []*XlogSrc{
+		{Server: cao, URL: "http://crawl.akrasiac.org/logfile-git", TargetPath: "cao/logfile-git"},
+		{Server: cao, URL: "http://crawl.akrasiac.org/milestones-git", TargetPath: "cao/milestones-git"},
+		{Server: cue, URL: "https://underhound.eu/logfile-git", TargetPath: "cue/logfile-git"},
+	}
+	new := []*XlogSrc{
+		{Server: cao, URL: "http://crawl.akrasiac.org/logfile-git", TargetPath: "cao/logfile-git"},
+		{Server: cao, URL: "https://crawl.akrasiac.org/milestones-git", TargetPath: "cao/milestones-git"},
+		{Server: cue, URL: "https://underhound.eu/milestones-git", TargetPath: "cue/milestones-git"},
+	}
+
+	targets := func(xlogs []*XlogSrc) []string {
+		res := []string{}
+		for _, x := range xlogs {
+			res = append(res, x.TargetPath)
+		}
+		return res
+	}
+	added, removed := DiffXlogs(old, new)
+	if a, expected := targets(added), []string{"cao/milestones-git", "cue/milestones-git"}; !reflect.DeepEqual(a, expected) {
+		t.Errorf("DiffXlogs added %#v, expected %#v", a, expected)
+	}
+	if r, expected := targets(removed), []string{"cao/milestones-git", "cue/logfile-git"}; !reflect.DeepEqual(r, expected) {
+		t.Errorf("DiffXlogs removed %#v, expected %#v", r, expected)
+	}
+
+	if added, removed := DiffXlogs(old, old); len(added) != 0 || len(removed) != 0 {
+		t.Errorf("DiffXlogs(old, old) = %d added, %d removed; expected no changes", len(added), len(removed))
+	}
+}
@@ -2,20 +2,43 @@ package xlog
 
 import (
 	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"strings"
 	"syscall"
+
+	"github.com/crawl/go-sequell/compression"
 )
 
 // ErrNoFile means an attempt was made to read a missing xlog
 var ErrNoFile = errors.New("xlog file not found")
 
+// ErrRewritten means that an xlog file no longer has the expected line at a
+// previously read offset: the file was truncated, rotated or rewritten.
+var ErrRewritten = errors.New("xlog file rewritten")
+
+// LineChecksum returns the checksum of an xlog line, ignoring trailing
+// whitespace. Every xlog entry read by Reader.Next has the checksum of its
+// line in the ":checksum" key.
+func LineChecksum(line string) string {
+	sum := sha1.Sum([]byte(strings.TrimRight(line, " \n\r\t")))
+	return hex.EncodeToString(sum[:])
+}
+
 // A Reader reads xlog entries from a logfile.
+//
+// Compressed logfiles (.gz, .bz2, .xz) are decompressed as they are read.
+// Offsets in compressed files are offsets in the uncompressed data; since
+// compressed files cannot seek, seeking backwards reopens the file and
+// decompresses it up to the offset, so compressed files should only be used
+// for logs that are no longer being written.
 type Reader struct {
 	// SourceKey is a unique identifier for the server this logfile is from
 	SourceKey string
@@ -25,15 +48,41 @@ type Reader struct {
 	File     *os.File
 	Offset   int64
 	Reader   *bufio.Reader
+
+	// Compression is the compression format of the file, identified by the
+	// extension of Path.
+	Compression compression.Format
+
+	// MalformedLines is the number of lines skipped because they could not
+	// be parsed.
+	MalformedLines int64
+
+	// OnMalformed, if set, is called with the offset, text and parse error
+	// of each line skipped because it could not be parsed.
+	OnMalformed func(offset int64, line string, err error)
+
+	// malformedEnd is the end of the last malformed line reported, so that
+	// lines read again after backing up at EOF are not reported again.
+	malformedEnd int64
+
+	// LastLine is the text of the line read by the last successful call to
+	// Next, without trailing whitespace.
+	LastLine string
+
+	// decompressor reads decompressed data from File, and readPos is the
+	// number of decompressed bytes consumed from Reader.
+	decompressor io.ReadCloser
+	readPos      int64
 }
 
 // NewReader creates a new Reader for the given absolute path, and dbFilename.
 // The dbFilename will be saved as the filename in the database.
 func NewReader(sourceKey, filepath, dbFilename string) *Reader {
 	return &Reader{
-		SourceKey: sourceKey,
-		Path:      filepath,
-		Filename:  dbFilename,
+		SourceKey:   sourceKey,
+		Path:        filepath,
+		Filename:    dbFilename,
+		Compression: compression.FilenameFormat(filepath),
 	}
 }
 
@@ -59,6 +108,10 @@ func (x *Reader) String() string {
 // Close closes the Reader's file handle.
 func (x *Reader) Close() error {
 	x.Reader = nil
+	if x.decompressor != nil {
+		x.decompressor.Close()
+		x.decompressor = nil
+	}
 	if x.File != nil {
 		if err := x.File.Close(); err != nil {
 			return err
@@ -78,12 +131,25 @@ func (x *Reader) open() error {
 		log.Println("Error opening file:", x.Path, err)
 		return translateErr(err)
 	}
-	x.Reader = bufio.NewReader(x.File)
+	x.readPos = 0
+	if x.Compression == compression.None {
+		x.Reader = bufio.NewReader(x.File)
+		return nil
+	}
+	x.decompressor, err = compression.NewReader(x.Compression, x.File)
+	if err != nil {
+		x.Close()
+		return fmt.Errorf("%s: %s", x.Path, err)
+	}
+	x.Reader = bufio.NewReader(x.decompressor)
 	return nil
 }
 
 // SeekOffset seeks to the given offset from the start of the file.
 func (x *Reader) SeekOffset(offset int64) error {
+	if x.Compression != compression.None {
+		return x.seekCompressed(offset)
+	}
 	if err := x.open(); err != nil {
 		return err
 	}
@@ -95,6 +161,28 @@ func (x *Reader) SeekOffset(offset int64) error {
 	return err
 }
 
+// seekCompressed seeks to offset in the decompressed file by reading and
+// discarding data, reopening the file first if offset is behind the current
+// read position. As with plain files, seeking past the end of the file is
+// not an error; subsequent reads return EOF.
+func (x *Reader) seekCompressed(offset int64) error {
+	if x.File != nil && offset < x.readPos {
+		if err := x.Close(); err != nil {
+			return err
+		}
+	}
+	if err := x.open(); err != nil {
+		return err
+	}
+	skipped, err := io.CopyN(ioutil.Discard, x.Reader, offset-x.readPos)
+	x.readPos += skipped
+	if err != nil && err != io.EOF {
+		return err
+	}
+	x.Offset = offset
+	return nil
+}
+
 // SeekNext seeks to the given offset, then reads and discards one
 // complete line. This is convenient if you have the offset of the
 // last processed line and want to resume reading on the next line.
@@ -110,11 +198,46 @@ func (x *Reader) SeekNext(offset int64) error {
 	return err
 }
 
+// SeekNextChecksum seeks to the given offset, and reads and discards one
+// complete line, verifying that the line's checksum matches checksum. If the
+// file is shorter than offset, or the line has a different checksum,
+// SeekNextChecksum returns ErrRewritten. An empty checksum is not verified.
+func (x *Reader) SeekNextChecksum(offset int64, checksum string) error {
+	if err := x.SeekOffset(offset); err != nil {
+		return err
+	}
+	line, err := x.ReadCompleteLine()
+	if err == io.EOF || (err == nil && checksum != "" && LineChecksum(line) != checksum) {
+		// The malformed lines reported are no longer in the file.
+		x.malformedEnd = 0
+		return ErrRewritten
+	}
+	if err != nil {
+		return err
+	}
+	x.Offset += int64(len(line))
+	return nil
+}
+
+// ForgetMalformed forgets that the malformed lines from offset on were
+// reported, so that they are reported again if read again, such as when
+// the rejects recorded for them were not saved.
+func (x *Reader) ForgetMalformed(offset int64) {
+	if offset < x.malformedEnd {
+		x.malformedEnd = offset
+	}
+}
+
 // BackToLastCompleteLine rewinds the XlogReader to the end of the
 // last complete line read, or the last place explicitly Seek()ed to;
 // does nothing if nothing read yet.
+//
+// Compressed files are not rewound: they are not appended to, so nothing
+// after the last complete line can change, and rewinding would decompress
+// the file again from the start. The reader stays at the end of the stream,
+// while Offset remains the end of the last complete line.
 func (x *Reader) BackToLastCompleteLine() error {
-	if x.File == nil {
+	if x.File == nil || x.Compression != compression.None {
 		return nil
 	}
 	return x.SeekOffset(x.Offset)
@@ -168,12 +291,22 @@ func (x *Reader) Next() (Xlog, error) {
 
 		parsedXlog, err := Parse(line, x.SourceKey)
 		if err != nil {
-			log.Printf("Xlog %s:%d skipping malformed line %#v\n",
-				x.Path, x.Offset+readOffset-lineLen, line)
+			offset := x.Offset + readOffset - lineLen
+			if offset >= x.malformedEnd {
+				log.Printf("Xlog %s:%d skipping malformed line %#v\n",
+					x.Path, offset, line)
+				x.MalformedLines++
+				x.malformedEnd = offset + lineLen
+				if x.OnMalformed != nil {
+					x.OnMalformed(offset, line, err)
+				}
+			}
 			continue
 		}
 		x.Offset += readOffset
+		x.LastLine = line
 		parsedXlog[":offset"] = strconv.FormatInt(x.Offset-lineLen, 10)
+		parsedXlog[":checksum"] = LineChecksum(line)
 		return parsedXlog, nil
 	}
 }
@@ -183,6 +316,7 @@ func (x *Reader) Next() (Xlog, error) {
 // line. The line returned is always empty or \n-terminated.
 func (x *Reader) ReadCompleteLine() (string, error) {
 	line, err := x.Reader.ReadString('\n')
+	x.readPos += int64(len(line))
 	if err != nil {
 		return "", err
 	}
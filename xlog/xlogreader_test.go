@@ -1,6 +1,11 @@
 package xlog
 
 import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 )
 
@@ -42,3 +47,205 @@ func TestReader(t *testing.T) {
 		}
 	}
 }
+
+func TestReaderSeekNextChecksum(t *testing.T) {
+	file := "cszo-git.log"
+	reader := NewReader("cszo", file, file)
+	defer reader.Close()
+	lines, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", file, err)
+	}
+	first := lines[0]
+	offset, err := strconv.ParseInt(first[":offset"], 10, 64)
+	if err != nil {
+		t.Fatalf("Bad offset %#v: %s", first[":offset"], err)
+	}
+
+	if err = reader.SeekNextChecksum(offset, first[":checksum"]); err != nil {
+		t.Errorf("SeekNextChecksum(%d, %s) failed: %s", offset, first[":checksum"], err)
+	}
+	next, err := reader.Next()
+	if err != nil || next["name"] != lines[1]["name"] {
+		t.Errorf("Next() after SeekNextChecksum = %#v (err: %v), expected %#v", next, err, lines[1])
+	}
+
+	if err = reader.SeekNextChecksum(offset, lines[1][":checksum"]); err != ErrRewritten {
+		t.Errorf("SeekNextChecksum with wrong checksum: err = %v, expected ErrRewritten", err)
+	}
+	if err = reader.SeekNextChecksum(1<<30, ""); err != ErrRewritten {
+		t.Errorf("SeekNextChecksum past EOF: err = %v, expected ErrRewritten", err)
+	}
+}
+
+func TestReaderCompressed(t *testing.T) {
+	file := "cszo-git.log"
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "xlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gzFile := filepath.Join(dir, file+".gz")
+	out, err := os.Create(gzFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(out)
+	gz.Write(text)
+	gz.Close()
+	out.Close()
+
+	plainLines, err := NewReader("cszo", file, file).ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", file, err)
+	}
+	reader := NewReader("cszo", gzFile, file)
+	defer reader.Close()
+	lines, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", gzFile, err)
+	}
+	if len(lines) != len(plainLines) {
+		t.Fatalf("Read %d lines from %s, expected %d", len(lines), gzFile, len(plainLines))
+	}
+	for i, line := range lines {
+		if line[":offset"] != plainLines[i][":offset"] || line[":checksum"] != plainLines[i][":checksum"] {
+			t.Errorf("Line %d: offset/checksum %s/%s, expected %s/%s", i+1,
+				line[":offset"], line[":checksum"],
+				plainLines[i][":offset"], plainLines[i][":checksum"])
+		}
+	}
+
+	// Seeking backwards reopens the file:
+	offset, _ := strconv.ParseInt(lines[3][":offset"], 10, 64)
+	if err = reader.SeekNextChecksum(offset, lines[3][":checksum"]); err != nil {
+		t.Errorf("SeekNextChecksum(%d) failed: %s", offset, err)
+	}
+	next, err := reader.Next()
+	if err != nil || next[":offset"] != lines[4][":offset"] {
+		t.Errorf("Next() after SeekNextChecksum = %#v (err: %v), expected %#v", next, err, lines[4])
+	}
+	if err = reader.SeekNextChecksum(1<<30, ""); err != ErrRewritten {
+		t.Errorf("SeekNextChecksum past EOF: err = %v, expected ErrRewritten", err)
+	}
+}
+
+func TestReaderCompressedTrailingLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const good = "name=Inkie:xl=3:end=20140808162913S"
+	gzFile := filepath.Join(dir, "logfile.gz")
+	out, err := os.Create(gzFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(out)
+	gz.Write([]byte(good + "\n\nname=Inkie:xl\n"))
+	gz.Close()
+	out.Close()
+
+	reader := NewReader("cszo", gzFile, "logfile")
+	defer reader.Close()
+	if x, err := reader.Next(); err != nil || x == nil {
+		t.Fatalf("Next() = %#v, %v; expected a line", x, err)
+	}
+	file := reader.File
+	for i := 0; i < 3; i++ {
+		if x, err := reader.Next(); err != nil || x != nil {
+			t.Fatalf("Next() at EOF = %#v, %v; expected nil", x, err)
+		}
+	}
+	if reader.File != file {
+		t.Errorf("Next() at EOF reopened the compressed file")
+	}
+	if reader.Offset != int64(len(good)+1) {
+		t.Errorf("Offset = %d, expected %d", reader.Offset, len(good)+1)
+	}
+	if reader.MalformedLines != 1 {
+		t.Errorf("MalformedLines = %d, expected 1", reader.MalformedLines)
+	}
+}
+
+func TestReaderMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const good = "name=Inkie:xl=3:end=20140808162913S"
+	const bad = "name=Inkie:xl"
+	file := filepath.Join(dir, "logfile")
+	if err := ioutil.WriteFile(file, []byte(good+"\n"+bad+"\n"+good+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var malformedOffsets []int64
+	var malformedLines []string
+	reader := NewReader("cszo", file, file)
+	defer reader.Close()
+	reader.OnMalformed = func(offset int64, line string, err error) {
+		malformedOffsets = append(malformedOffsets, offset)
+		malformedLines = append(malformedLines, line)
+	}
+	lines, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", file, err)
+	}
+	if len(lines) != 2 || reader.MalformedLines != 1 {
+		t.Errorf("Read %d lines, %d malformed; expected 2 lines, 1 malformed", len(lines), reader.MalformedLines)
+	}
+	if len(malformedLines) != 1 || malformedLines[0] != bad || malformedOffsets[0] != int64(len(good)+1) {
+		t.Errorf("OnMalformed called with %#v at %v, expected %#v at %d", malformedLines, malformedOffsets, bad, len(good)+1)
+	}
+	if reader.LastLine != good {
+		t.Errorf("LastLine = %#v, expected %#v", reader.LastLine, good)
+	}
+}
+
+func TestReaderMalformedAtEOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const good = "name=Inkie:xl=3:end=20140808162913S"
+	const bad = "name=Inkie:xl"
+	file := filepath.Join(dir, "logfile")
+	if err := ioutil.WriteFile(file, []byte(good+"\n"+bad+"\n"+bad+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reports := 0
+	reader := NewReader("cszo", file, file)
+	defer reader.Close()
+	reader.OnMalformed = func(offset int64, line string, err error) {
+		reports++
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadAll(); err != nil {
+			t.Fatalf("Unexpected error reading %s: %s", file, err)
+		}
+	}
+	if reader.MalformedLines != 2 || reports != 2 {
+		t.Errorf("MalformedLines = %d, %d reports; expected 2", reader.MalformedLines, reports)
+	}
+
+	reader.ForgetMalformed(int64(len(good)+len(bad)) + 2)
+	if _, err := reader.ReadAll(); err != nil {
+		t.Fatalf("Unexpected error reading %s: %s", file, err)
+	}
+	if reader.MalformedLines != 3 || reports != 3 {
+		t.Errorf("MalformedLines = %d, %d reports after ForgetMalformed; expected 3", reader.MalformedLines, reports)
+	}
+}